@@ -31,8 +31,8 @@ all()
 # 3 Create Aacmedmin all on kevlarWeb db
   $CMD < acmeGrantAdmin.sql
 
-# 4 Create acmeTable 
-  $CMD < usersCreateTable.sql
+# Tables are created by the migrations embedded in the users binary
+# see: users migrate up
 }
 
 usage()
@@ -1,4 +1,3 @@
-
 CREATE TABLE IF NOT EXISTS Acme.users (
     UsersUUID UUID DEFAULT uuid_v4()::UUID PRIMARY KEY,
     users JSONB
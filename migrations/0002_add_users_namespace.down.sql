@@ -0,0 +1,2 @@
+-- migrate:no-transaction
+ALTER TABLE Acme.users DROP COLUMN IF EXISTS namespace CASCADE;
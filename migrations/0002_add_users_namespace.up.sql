@@ -0,0 +1,3 @@
+-- migrate:no-transaction
+-- Tables created before namespaces hold every record in the default one
+ALTER TABLE Acme.users ADD COLUMN IF NOT EXISTS namespace STRING NOT NULL DEFAULT 'pavedroad.io';
@@ -0,0 +1,2 @@
+-- migrate:no-transaction
+ALTER TABLE Acme.users ALTER PRIMARY KEY USING COLUMNS (UsersUUID);
@@ -0,0 +1,3 @@
+-- migrate:no-transaction
+-- A primary key change runs as a schema job, it can not share a transaction
+ALTER TABLE Acme.users ALTER PRIMARY KEY USING COLUMNS (namespace, UsersUUID);
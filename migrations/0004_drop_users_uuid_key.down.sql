@@ -0,0 +1,2 @@
+-- migrate:no-transaction
+CREATE UNIQUE INDEX IF NOT EXISTS users_usersuuid_key ON Acme.users (UsersUUID);
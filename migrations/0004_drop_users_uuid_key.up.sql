@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+-- ALTER PRIMARY KEY keeps the old key as a unique index, it would stop
+-- clones from reusing a UUID in another namespace
+DROP INDEX IF EXISTS Acme.users@users_usersuuid_key CASCADE;
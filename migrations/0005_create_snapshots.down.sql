@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS Acme.usersSnapshotRecords;
+
+DROP TABLE IF EXISTS Acme.usersSnapshots;
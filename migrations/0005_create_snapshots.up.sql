@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS Acme.usersSnapshots (
+    namespace STRING NOT NULL,
+    name STRING NOT NULL,
+    created TIMESTAMPTZ NOT NULL,
+    records INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (namespace, name)
+);
+
+CREATE TABLE IF NOT EXISTS Acme.usersSnapshotRecords (
+    namespace STRING NOT NULL,
+    name STRING NOT NULL,
+    UsersUUID UUID NOT NULL,
+    users JSONB,
+    PRIMARY KEY (namespace, name, UsersUUID)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS Acme.usersAPIKeys (
+    id UUID PRIMARY KEY,
+    name STRING NOT NULL,
+    hash BYTES NOT NULL,
+    namespaces STRING[] NOT NULL,
+    verbs STRING[] NOT NULL,
+    created TIMESTAMPTZ NOT NULL,
+    expires TIMESTAMPTZ,
+    revoked TIMESTAMPTZ
+);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS Acme.usersAudit (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    occurred TIMESTAMPTZ NOT NULL,
+    namespace STRING NOT NULL,
+    UsersUUID UUID NOT NULL,
+    action STRING NOT NULL,
+    identity STRING NOT NULL,
+    method STRING NOT NULL,
+    client STRING NOT NULL,
+    userAgent STRING NOT NULL,
+    requestID STRING NOT NULL,
+    beforeDoc JSONB,
+    afterDoc JSONB,
+    INDEX usersAuditTimeIdx (namespace, occurred DESC),
+    INDEX usersAuditKeyIdx (UsersUUID, occurred DESC)
+);
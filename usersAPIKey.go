@@ -0,0 +1,301 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// APIKeyHeader carries an API key
+const APIKeyHeader string = "X-API-Key"
+
+// apiKeyPrefix starts every API key so leaked keys are easy to find
+const apiKeyPrefix string = "usersk_"
+
+// apiKeySecretBytes is the amount of randomness in a key
+const apiKeySecretBytes = 32
+
+// apiKeyNameRE limits key names to values that are safe to log
+var apiKeyNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// errInvalidAPIKey hides which part of a presented key was wrong
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// apiKey is a credential for callers that can not use bearer tokens,
+// only a hash of the secret is stored
+//
+// swagger:model apiKey
+type apiKey struct {
+	// ID: identifies the key, it is part of the key
+	ID string `json:"id"`
+	// Name: the identity of callers using the key
+	Name string `json:"name"`
+	// Namespaces: the key is refused for any other namespace
+	Namespaces []string `json:"namespaces"`
+	// Verbs: get, list, create, update, or delete
+	Verbs   []string   `json:"verbs"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+	// Key: the API key, only returned when it is created
+	Key string `json:"key,omitempty"`
+}
+
+// apiKeyRequest creates an API key
+//
+// swagger:parameters createapikey
+type apiKeyRequest struct {
+	Name       string     `json:"name"`
+	Namespaces []string   `json:"namespaces"`
+	Verbs      []string   `json:"verbs"`
+	Expires    *time.Time `json:"expires"`
+}
+
+// apiKeyList is returned by GET /admin/apikeys
+//
+// swagger:response apiKeyList
+type apiKeyList struct {
+	// in: body
+	Body []apiKey
+}
+
+// hashAPIKeySecret returns the stored form of a secret.  The secret is
+// random so a fast hash is enough
+func hashAPIKeySecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// parseAPIKey splits a presented key into its ID and secret
+func parseAPIKey(key string) (string, string, error) {
+	rest := strings.TrimPrefix(key, apiKeyPrefix)
+	if rest == key {
+		return "", "", errInvalidAPIKey
+	}
+
+	// The ID is hex so the first _ ends it, the secret may contain _
+	parts := strings.SplitN(rest, "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", errInvalidAPIKey
+	}
+
+	id, err := uuid.Parse(parts[0])
+	if err != nil {
+		return "", "", errInvalidAPIKey
+	}
+	return id.String(), parts[1], nil
+}
+
+// allows reports whether the key may do verb in namespace
+func (k *apiKey) allows(namespace, verb string) bool {
+	return contains(k.Namespaces, namespace) && contains(k.Verbs, verb)
+}
+
+// validate checks a create request
+func (req *apiKeyRequest) validate() error {
+	if !apiKeyNameRE.MatchString(req.Name) {
+		return errInvalid("invalid API key name: %s", req.Name)
+	}
+	if len(req.Namespaces) == 0 {
+		return errInvalid("at least one namespace is required")
+	}
+	for _, ns := range req.Namespaces {
+		if !namespaceRE.MatchString(ns) {
+			return errInvalid("invalid namespace: %s", ns)
+		}
+	}
+	if len(req.Verbs) == 0 {
+		return errInvalid("at least one verb is required")
+	}
+	for _, v := range req.Verbs {
+		if !contains(verbs, v) {
+			return errInvalid("verb %q must be one of %s", v, strings.Join(verbs, ", "))
+		}
+	}
+	if req.Expires != nil && !req.Expires.After(time.Now()) {
+		return errInvalid("expires must be in the future")
+	}
+	return nil
+}
+
+// createAPIKey stores a new key and returns it with the secret set
+func createAPIKey(ctx context.Context, db *sql.DB, req apiKeyRequest) (apiKey, error) {
+	defer observeDB(ctx, "createAPIKey")()
+
+	if err := req.validate(); err != nil {
+		return apiKey{}, err
+	}
+
+	secret := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return apiKey{}, err
+	}
+
+	id := uuid.New()
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	k := apiKey{
+		ID:         id.String(),
+		Name:       req.Name,
+		Namespaces: req.Namespaces,
+		Verbs:      req.Verbs,
+		Created:    time.Now().UTC(),
+		Expires:    req.Expires,
+		Key:        apiKeyPrefix + strings.ReplaceAll(id.String(), "-", "") + "_" + encoded,
+	}
+
+	statement := `
+  INSERT INTO Acme.usersAPIKeys(id, name, hash, namespaces, verbs, created, expires)
+  VALUES ($1, $2, $3, $4, $5, $6, $7);`
+	err := runInTx(ctx, db, "createAPIKey", func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, statement, k.ID, k.Name, hashAPIKeySecret(encoded),
+			pq.Array(k.Namespaces), pq.Array(k.Verbs), k.Created, k.Expires)
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Insert failed", "key", k.ID, "error", err)
+		return apiKey{}, err
+	}
+
+	return k, nil
+}
+
+// apiKeyColumns are scanned by scanAPIKey
+const apiKeyColumns = `id, name, namespaces, verbs, created, expires, revoked`
+
+// scanAPIKey reads the apiKeyColumns of a row
+func scanAPIKey(scan func(dest ...interface{}) error, k *apiKey, extra ...interface{}) error {
+	var expires, revoked sql.NullTime
+	dest := append([]interface{}{&k.ID, &k.Name, pq.Array(&k.Namespaces), pq.Array(&k.Verbs),
+		&k.Created, &expires, &revoked}, extra...)
+	if err := scan(dest...); err != nil {
+		return err
+	}
+	if expires.Valid {
+		k.Expires = &expires.Time
+	}
+	if revoked.Valid {
+		k.Revoked = &revoked.Time
+	}
+	return nil
+}
+
+// listAPIKeys returns every key, secrets are never returned
+func listAPIKeys(ctx context.Context, db *sql.DB) ([]apiKey, error) {
+	defer observeDB(ctx, "listAPIKeys")()
+
+	statement := `SELECT ` + apiKeyColumns + ` FROM Acme.usersAPIKeys ORDER BY created;`
+	rows, err := db.QueryContext(ctx, statement)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	kl := []apiKey{}
+	for rows.Next() {
+		var k apiKey
+		if err := scanAPIKey(rows.Scan, &k); err != nil {
+			slog.ErrorContext(ctx, "SQL rows.Scan failed", "error", err)
+			return kl, err
+		}
+		kl = append(kl, k)
+	}
+
+	return kl, rows.Err()
+}
+
+// revokeAPIKey stops a key from being accepted, the record is kept
+func revokeAPIKey(ctx context.Context, db *sql.DB, id string) (apiKey, error) {
+	defer observeDB(ctx, "revokeAPIKey")()
+
+	var k apiKey
+	if _, err := uuid.Parse(id); err != nil {
+		return k, errInvalidUUID(id)
+	}
+
+	statement := `
+  UPDATE Acme.usersAPIKeys SET revoked = COALESCE(revoked, now())
+  WHERE id = $1 RETURNING ` + apiKeyColumns + `;`
+	err := runInTx(ctx, db, "revokeAPIKey", func(tx *sql.Tx) error {
+		return scanAPIKey(tx.QueryRowContext(ctx, statement, id).Scan, &k)
+	})
+	if err == sql.ErrNoRows {
+		return k, errNotFound("API key %s does not exist", id)
+	}
+
+	return k, err
+}
+
+// authenticateAPIKey returns the key matching a presented one, expired
+// and revoked keys are refused
+func authenticateAPIKey(ctx context.Context, db *sql.DB, presented string) (*apiKey, error) {
+	defer observeDB(ctx, "authenticateAPIKey")()
+
+	id, secret, err := parseAPIKey(presented)
+	if err != nil {
+		return nil, err
+	}
+
+	var k apiKey
+	var hash []byte
+	statement := `SELECT ` + apiKeyColumns + `, hash FROM Acme.usersAPIKeys WHERE id = $1;`
+	err = scanAPIKey(db.QueryRowContext(ctx, statement, id).Scan, &k, &hash)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare(hash, hashAPIKeySecret(secret)) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	if k.Revoked != nil {
+		return nil, errors.New("API key was revoked")
+	}
+	if k.Expires != nil && time.Now().After(*k.Expires) {
+		return nil, errors.New("API key expired")
+	}
+
+	return &k, nil
+}
+
+// apiKeyScope refuses requests outside the namespaces and verbs of the
+// key, it returns the reason or "" when the request is allowed
+func apiKeyScope(r *http.Request, k *apiKey) string {
+	namespace := mux.Vars(r)["namespace"]
+	if !strings.HasPrefix(r.URL.Path, UsersAPIVersion+"/") || namespace == "" {
+		if protectedPath(r.URL.Path) {
+			return "API keys can only access namespaces"
+		}
+		return ""
+	}
+
+	verb := requestVerb(r)
+	if !k.allows(namespace, verb) {
+		return fmt.Sprintf("API key %s can not %s in namespace %s", k.Name, verb, namespace)
+	}
+	return ""
+}
@@ -15,11 +15,17 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -27,156 +33,225 @@ import (
 //
 func (a *UsersApp) Initialize() {
 
-	// Override defaults
-	a.initializeEnvironment()
+	logLevel.Set(currentConfig().logLevel())
 
-	// Build connection strings
-	connectionString := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=%s host=%s port=%s",
-		dbconf.username,
-		dbconf.password,
-		dbconf.database,
-		dbconf.sslMode,
-		dbconf.ip,
-		dbconf.port)
+	if err := a.initializeTracing(); err != nil {
+		slog.Error("Tracing setup failed", "error", err)
+		os.Exit(1)
+	}
 
-	httpconf.listenString = fmt.Sprintf("%s:%s", httpconf.ip, httpconf.port)
+	if err := a.initializeAuth(); err != nil {
+		slog.Error("Authentication setup failed", "error", err)
+		os.Exit(1)
+	}
 
-	var err error
-	a.DB, err = sql.Open(dbconf.dbDriver, connectionString)
-	if err != nil {
-		log.Fatal(err)
+	a.initializeDB()
+
+	// Without a database requests get 503 until it answers
+	if err := a.waitForDB(); err != nil {
+		if currentConfig().Database.AutoMigrate {
+			slog.Error("Database unavailable, can not migrate", "error", err)
+			os.Exit(1)
+		}
+		slog.Error("Database unavailable, starting degraded", "error", err)
+		a.breaker.trip()
+	}
+
+	if currentConfig().Database.AutoMigrate {
+		if _, err := migrateUp(a.DB); err != nil {
+			slog.Error("Migrations failed", "error", err)
+			os.Exit(1)
+		}
 	}
 
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 }
 
-// Start the server
-func (a *UsersApp) Run(addr string) {
+// initializeDB opens the database connection pool
+func (a *UsersApp) initializeDB() {
+	dbc := currentConfig().Database
 
-	log.Println("Listing at: " + addr)
+	var err error
+	a.DB, err = sql.Open(dbc.Driver, dbc.connectionString())
+	if err != nil {
+		slog.Error("Opening database failed", "error", err)
+		os.Exit(1)
+	}
+	a.applyPool()
+}
+
+// Start the server and block until SIGINT or SIGTERM, returns the
+// process exit status
+func (a *UsersApp) Run(addr string) int {
+
+	slog.Info("Listening", "addr", addr)
 	srv := &http.Server{
 		Handler:      a.Router,
 		Addr:         addr,
-		WriteTimeout: httpconf.writeTimeout * time.Second,
-		ReadTimeout:  httpconf.readTimeout * time.Second,
+		WriteTimeout: currentConfig().HTTP.WriteTimeout,
+		ReadTimeout:  currentConfig().HTTP.ReadTimeout,
+	}
+
+	useTLS, err := a.initializeTLS(srv)
+	if err != nil {
+		slog.Error("TLS setup failed", "error", err)
+		return 1
 	}
 
+	// Certificates come from srv.TLSConfig
+	serveErr := make(chan error, 1)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+		if useTLS {
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- srv.ListenAndServe()
 		}
 	}()
 
-	// Listen for SIGHUP
+	if path := configFile(a.flags); path != "" {
+		a.startWorker("configWatcher", func(ctx context.Context) {
+			a.watchConfigFile(ctx, path)
+		})
+	}
+
+	// Listen for SIGINT and SIGTERM, SIGHUP reloads the configuration
 	c := make(chan os.Signal, 1)
-	<-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	status := 0
+wait:
+	for {
+		select {
+		case sig := <-c:
+			if sig == syscall.SIGHUP {
+				if err := a.reloadConfig(); err != nil {
+					slog.Error("Configuration reload failed", "error", err)
+				}
+				continue
+			}
+			slog.Info("Draining connections", "signal", sig.String())
+		case err := <-serveErr:
+			// The server never started or stopped on its own
+			slog.Error("HTTP server failed", "error", err)
+			status = 1
+		}
+		break wait
+	}
 
 	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), httpconf.shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), currentConfig().HTTP.ShutdownTimeout)
 	defer cancel()
 
-	// Doesn't block if no connections, but will otherwise wait
+	// Stops accepting connections and waits for in flight requests
 	// until the timeout deadline.
-	if err := srv.Shutdown(ctx); err != http.ErrServerClosed {
-		log.Printf("HTTP server shut down: %v", err)
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server shut down", "error", err)
+		status = 1
 	}
-	log.Println("shutting down")
-	os.Exit(0)
-}
 
-// Get for ennvironment variable overrides
-func (a *UsersApp) initializeEnvironment() {
-	var envVar = ""
-
-	//look for environment variables overrides
-	envVar = os.Getenv("APP_DB_USERNAME")
-	if envVar != "" {
-		dbconf.username = envVar
+	if err := a.stopWorkers(ctx); err != nil {
+		slog.Error("Background workers did not stop", "error", err)
+		status = 1
 	}
 
-	envVar = os.Getenv("APP_DB_PASSWORD")
-	if envVar != "" {
-		dbconf.password = envVar
+	if err := a.shutdownTracing(ctx); err != nil {
+		slog.Error("Flushing traces failed", "error", err)
+		status = 1
 	}
 
-	envVar = os.Getenv("APP_DB_NAME")
-	if envVar != "" {
-		dbconf.database = envVar
-	}
-	envVar = os.Getenv("APP_DB_SSL_MODE")
-	if envVar != "" {
-		dbconf.sslMode = envVar
+	if a.DB != nil {
+		if err := a.DB.Close(); err != nil {
+			slog.Error("Closing database failed", "error", err)
+			status = 1
+		}
 	}
 
-	envVar = os.Getenv("APP_DB_SQL_DRIVER")
-	if envVar != "" {
-		dbconf.dbDriver = envVar
-	}
+	slog.Info("Shutting down", "status", status)
+	return status
+}
 
-	envVar = os.Getenv("APP_DB_IP")
-	if envVar != "" {
-		dbconf.ip = envVar
-	}
+// startWorker runs fn in the background, fn must return once its
+// context is canceled so shutdown can wait for it
+func (a *UsersApp) startWorker(name string, fn func(ctx context.Context)) {
+	a.workersOnce.Do(func() {
+		a.workersCtx, a.workersCancel = context.WithCancel(context.Background())
+	})
 
-	envVar = os.Getenv("APP_DB_PORT")
-	if envVar != "" {
-		dbconf.port = envVar
-	}
+	a.setWorkerStatus(name, true)
 
-	envVar = os.Getenv("HTTP_IP_ADDR")
-	if envVar != "" {
-		httpconf.ip = envVar
-	}
+	a.workers.Add(1)
+	go func() {
+		defer a.workers.Done()
+		fn(a.workersCtx)
+		a.setWorkerStatus(name, false)
+		slog.Info("Worker stopped", "worker", name)
+	}()
+}
 
-	envVar = os.Getenv("HTTP_IP_PORT")
-	if envVar != "" {
-		httpconf.port = envVar
-	}
+// setWorkerStatus records whether a worker is running
+func (a *UsersApp) setWorkerStatus(name string, running bool) {
+	a.workersMu.Lock()
+	defer a.workersMu.Unlock()
 
-	envVar = os.Getenv("HTTP_READ_TIMEOUT")
-	if envVar != "" {
-		to, err := strconv.Atoi(envVar)
-		if err == nil {
-			log.Printf("failed to convert HTTP_READ_TIMEOUT: %s to int", envVar)
-		} else {
-			httpconf.readTimeout = time.Duration(to) * time.Second
-		}
-		log.Printf("Read timeout: %d", httpconf.readTimeout)
+	if a.workerStatus == nil {
+		a.workerStatus = map[string]bool{}
 	}
+	a.workerStatus[name] = running
+}
 
-	envVar = os.Getenv("HTTP_WRITE_TIMEOUT")
-	if envVar != "" {
-		to, err := strconv.Atoi(envVar)
-		if err == nil {
-			log.Printf("failed to convert HTTP_READ_TIMEOUT: %s to int", envVar)
-		} else {
-			httpconf.writeTimeout = time.Duration(to) * time.Second
-		}
-		log.Printf("Write timeout: %d", httpconf.writeTimeout)
-	}
+// stopWorkers cancels the background workers and waits for them
+// until ctx expires
+func (a *UsersApp) stopWorkers(ctx context.Context) error {
+	a.workersMu.Lock()
+	a.shuttingDown = true
+	a.workersMu.Unlock()
 
-	envVar = os.Getenv("HTTP_SHUTDOWN_TIMEOUT")
-	if envVar != "" {
-		if envVar != "" {
-			to, err := strconv.Atoi(envVar)
-			if err != nil {
-				httpconf.shutdownTimeout = time.Second * time.Duration(to)
-			} else {
-				httpconf.shutdownTimeout = time.Second * httpconf.shutdownTimeout
-			}
-			log.Println("Shutdown timeout", httpconf.shutdownTimeout)
-		}
+	if a.workersCancel == nil {
+		return nil
 	}
+	a.workersCancel()
 
-	envVar = os.Getenv("HTTP_LOG")
-	if envVar != "" {
-		httpconf.logPath = envVar
-	}
+	done := make(chan struct{})
+	go func() {
+		a.workers.Wait()
+		close(done)
+	}()
 
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (a *UsersApp) initializeRoutes() {
+	a.Router.Use(requestIDMiddleware)
+	a.Router.Use(metricsMiddleware)
+	a.Router.Use(recoverMiddleware)
+	a.Router.Use(tracingMiddleware)
+	a.Router.Use(logRequest)
+	a.Router.Use(auditMiddleware)
+	a.Router.Use(clientCertMiddleware)
+	a.Router.Use(a.rateLimitMiddleware)
+	a.Router.Use(a.authMiddleware)
+	a.Router.Use(a.identityRateLimitMiddleware)
+	a.Router.Use(rbacMiddleware)
+	a.Router.Use(timeoutMiddleware)
+	a.Router.Use(a.storeMiddleware)
+
+	// The router only runs middleware on matched routes
+	unmatched := func(h http.HandlerFunc) http.Handler {
+		return requestIDMiddleware(metricsMiddleware(logRequest(h)))
+	}
+	a.Router.NotFoundHandler = unmatched(notFoundHandler)
+	a.Router.MethodNotAllowedHandler = unmatched(methodNotAllowedHandler)
+	a.initializeHealthRoutes()
+	a.initializeAdminRoutes()
+	a.initializeMetricsRoutes()
+
 	uri := UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" +
 		UsersResourceType + "LIST"
 	a.Router.HandleFunc(uri, a.listUsers).Methods("GET")
@@ -195,6 +270,42 @@ func (a *UsersApp) initializeRoutes() {
 	uri = UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" +
 		UsersResourceType + UsersKey
 	a.Router.HandleFunc(uri, a.deleteUsers).Methods("DELETE")
+
+	uri = UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" +
+		UsersResourceType + "GENERATE"
+	a.Router.HandleFunc(uri, a.generateUsers).Methods("POST")
+
+	uri = UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" +
+		UsersResourceType + "SCHEMA"
+	a.Router.HandleFunc(uri, a.inferStoredSchema).Methods("GET")
+	a.Router.HandleFunc(uri, a.inferSampleSchema).Methods("POST")
+
+	uri = UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" + UsersSnapshots
+	a.Router.HandleFunc(uri, a.createSnapshot).Methods("POST")
+	a.Router.HandleFunc(uri, a.listSnapshots).Methods("GET")
+
+	uri = UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" +
+		UsersSnapshots + "/{name}"
+	a.Router.HandleFunc(uri, a.deleteSnapshot).Methods("DELETE")
+
+	uri = UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" +
+		UsersSnapshots + "/{name}/restore"
+	a.Router.HandleFunc(uri, a.restoreSnapshot).Methods("POST")
+
+	uri = UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" + UsersClone
+	a.Router.HandleFunc(uri, a.cloneNamespace).Methods("POST")
+
+	uri = UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" +
+		UsersResourceType + "EXPORT"
+	a.Router.HandleFunc(uri, a.exportUsers).Methods("POST")
+
+	for _, path := range usersChildTables {
+		uri = UsersAPIVersion + "/" + UsersNamespaceID + "/{namespace}/" +
+			UsersResourceType + UsersKey + "/" + strings.ToLower(strings.Join(path, "/"))
+		a.Router.HandleFunc(uri, a.getUsersChild(path)).Methods("GET")
+		a.Router.HandleFunc(uri, a.updateUsersChild(path, false)).Methods("PUT")
+		a.Router.HandleFunc(uri, a.updateUsersChild(path, true)).Methods("PATCH")
+	}
 }
 
 // listUsers swagger:route GET /api/v1/namespace/pavedroad.io/usersLIST users listusers
@@ -218,9 +329,10 @@ func (a *UsersApp) listUsers(w http.ResponseWriter, r *http.Request) {
 		start = 0
 	}
 
-	mappings, err := users.listUsers(a.DB, start, count)
+	vars := mux.Vars(r)
+	mappings, err := users.listUsers(r.Context(), a.DB, vars["namespace"], start, count)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithModelError(w, err)
 		return
 	}
 
@@ -240,16 +352,10 @@ func (a *UsersApp) getUsers(w http.ResponseWriter, r *http.Request) {
 	users := users{}
 
 	//TODO: allows them to specify the column used to retrieve user
-	err := users.getUsers(a.DB, vars["key"], UUID)
+	err := users.getUsers(r.Context(), a.DB, vars["namespace"], vars["key"], UUID)
 
 	if err != nil {
-		errmsg := err.Error()
-		errno := errmsg[0:3]
-		if errno == "400" {
-			respondWithError(w, http.StatusBadRequest, err.Error())
-		} else {
-			respondWithError(w, http.StatusNotFound, err.Error())
-		}
+		respondWithModelError(w, err)
 		return
 	}
 
@@ -264,20 +370,23 @@ func (a *UsersApp) getUsers(w http.ResponseWriter, r *http.Request) {
 //    default: genericError
 //        201: usersResponse
 //        400: genericError
+//        507: genericError
 func (a *UsersApp) createUsers(w http.ResponseWriter, r *http.Request) {
 	// New map structure
 	users := users{}
 
 	htmlData, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println(err)
-		os.Exit(1)
+		slog.ErrorContext(r.Context(), "Reading request failed", "error", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
 	}
 
 	err = json.Unmarshal(htmlData, &users)
 	if err != nil {
-		log.Println(err)
-		os.Exit(1)
+		slog.WarnContext(r.Context(), "Invalid request payload", "error", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
 	}
 
 	ct := time.Now().UTC()
@@ -286,8 +395,9 @@ func (a *UsersApp) createUsers(w http.ResponseWriter, r *http.Request) {
 
 	// Save into backend storage
 	// returns the UUID if needed
-	if _, err := users.createUsers(a.DB); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	vars := mux.Vars(r)
+	if _, err := users.createUsers(r.Context(), a.DB, vars["namespace"]); err != nil {
+		respondWithModelError(w, err)
 		return
 	}
 
@@ -296,35 +406,47 @@ func (a *UsersApp) createUsers(w http.ResponseWriter, r *http.Request) {
 
 // updateUsers swagger:route PUT /api/v1/namespace/pavedroad.io/users/{key} users updateusers
 //
-// Update a users specified by key, where key is a uuid
+// Update a users specified by key, where key is a uuid.  A UsersUUID in
+// the body must match the key
 //
 // Responses:
 //    default: genericError
 //        201: usersResponse
 //        400: genericError
+//        404: genericError
+//        507: genericError
 func (a *UsersApp) updateUsers(w http.ResponseWriter, r *http.Request) {
 	users := users{}
 
 	// Read URI variables
-	// vars := mux.Vars(r)
+	vars := mux.Vars(r)
 
 	htmlData, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(r.Context(), "Reading request failed", "error", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
 	err = json.Unmarshal(htmlData, &users)
 	if err != nil {
-		log.Println(err)
+		slog.WarnContext(r.Context(), "Invalid request payload", "error", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	key := vars["key"]
+	if users.UsersUUID != "" && !strings.EqualFold(users.UsersUUID, key) {
+		respondWithError(w, http.StatusBadRequest, "UsersUUID "+users.UsersUUID+" does not match the key "+key)
 		return
 	}
+	users.UsersUUID = key
 
 	ct := time.Now().UTC()
 	users.Updated = ct
 
-	if err := users.updateUsers(a.DB, users.UsersUUID); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if err := users.updateUsers(r.Context(), a.DB, vars["namespace"], key); err != nil {
+		respondWithModelError(w, err)
 		return
 	}
 
@@ -343,17 +465,558 @@ func (a *UsersApp) deleteUsers(w http.ResponseWriter, r *http.Request) {
 	users := users{}
 	vars := mux.Vars(r)
 
-	err := users.deleteUsers(a.DB, vars["key"])
+	err := users.deleteUsers(r.Context(), a.DB, vars["namespace"], vars["key"])
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, err.Error())
+		respondWithModelError(w, err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
-func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+// generateUsers swagger:route POST /api/v1/namespace/pavedroad.io/usersGENERATE users generateusers
+//
+// Generate and store random users, fields can specify null ratios,
+// distributions, uniqueness, and time windows.  With mode set to edge
+// records are built from boundary and hostile values for each column type.
+// The records are stored in one transaction, all of them or none
+//
+// Responses:
+//    default: genericError
+//        201: usersList
+//        400: genericError
+func (a *UsersApp) generateUsers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	req := generateRequest{}
+
+	htmlData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := json.Unmarshal(htmlData, &req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	g, err := newGenerator(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, span := tracer().Start(r.Context(), "generate",
+		trace.WithAttributes(attribute.Int("users.count", req.Count)))
+	docs, err := g.generate(req.Count)
+	span.End()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	batch := make([][]byte, 0, len(docs))
+	for _, d := range docs {
+		jb, err := json.Marshal(d)
+		if err != nil {
+			respondWithModelError(w, err)
+			return
+		}
+		batch = append(batch, jb)
+	}
+
+	uids, err := createUsersDocuments(r.Context(), a.DB, vars["namespace"], batch)
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	created := make([]listResponse, 0, len(uids))
+	for _, uid := range uids {
+		created = append(created, listResponse{UUID: uid})
+	}
+
+	respondWithJSON(w, http.StatusCreated, created)
+}
+
+// inferStoredSchema swagger:route GET /api/v1/namespace/pavedroad.io/usersSCHEMA users inferstoredschema
+//
+// Infer a tables definition in testDataMgr.yaml format from stored users.
+// The number of documents scanned is limited by the limit parameter
+//
+// Responses:
+//    default: genericError
+//        200: schemaResponse
+func (a *UsersApp) inferStoredSchema(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if limit < 1 || limit > maxSchemaSample {
+		limit = defaultSchemaSample
+	}
+
+	vars := mux.Vars(r)
+	s := newSchemaInferrer(UsersResourceType)
+	if err := scanUsersDocuments(r.Context(), a.DB, vars["namespace"], limit, s.addDocument); err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	respondWithSchema(w, s)
+}
+
+// inferSampleSchema swagger:route POST /api/v1/namespace/pavedroad.io/usersSCHEMA users infersampleschema
+//
+// Infer a tables definition in testDataMgr.yaml format from an
+// uploaded NDJSON sample, one document per line
+//
+// Responses:
+//    default: genericError
+//        200: schemaResponse
+//        400: genericError
+func (a *UsersApp) inferSampleSchema(w http.ResponseWriter, r *http.Request) {
+	s := newSchemaInferrer(UsersResourceType)
+
+	n, err := s.addNDJSON(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusBadRequest, "no documents in sample")
+		return
+	}
+
+	respondWithSchema(w, s)
+}
+
+// respondWithSchema writes an inferred schema as YAML
+func respondWithSchema(w http.ResponseWriter, s *schemaInferrer) {
+	yb, err := s.yaml()
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(yb); err != nil {
+		slog.Error("Response failed", "error", err, "request_id", w.Header().Get(RequestIDHeader))
+	}
+}
+
+// createSnapshot swagger:route POST /api/v1/namespace/pavedroad.io/snapshots snapshots createsnapshot
+//
+// Capture all users in the namespace under the name given in the body
+//
+// Responses:
+//    default: genericError
+//        201: snapshot
+//        400: genericError
+//        409: genericError
+func (a *UsersApp) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s := snapshot{}
+
+	htmlData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := json.Unmarshal(htmlData, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	s.Namespace = vars["namespace"]
+
+	if err := s.createSnapshot(r.Context(), a.DB); err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, s)
+}
+
+// listSnapshots swagger:route GET /api/v1/namespace/pavedroad.io/snapshots snapshots listsnapshots
+//
+// Returns the snapshots taken of the namespace
+//
+// Responses:
+//    default: genericError
+//        200: snapshotList
+func (a *UsersApp) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	sl, err := listSnapshots(r.Context(), a.DB, vars["namespace"])
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, sl)
+}
+
+// restoreSnapshot swagger:route POST /api/v1/namespace/pavedroad.io/snapshots/{name}/restore snapshots restoresnapshot
+//
+// Atomically reset the namespace to the contents of a snapshot
+//
+// Responses:
+//    default: genericError
+//        200: snapshot
+//        404: genericError
+func (a *UsersApp) restoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s := snapshot{Namespace: vars["namespace"], Name: vars["name"]}
+
+	if err := s.restoreSnapshot(r.Context(), a.DB); err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+// deleteSnapshot swagger:route DELETE /api/v1/namespace/pavedroad.io/snapshots/{name} snapshots deletesnapshot
+//
+// Delete a snapshot, the namespace is not changed
+//
+// Responses:
+//    default: genericError
+//        200: genericError
+//        404: genericError
+func (a *UsersApp) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s := snapshot{Namespace: vars["namespace"], Name: vars["name"]}
+
+	if err := s.deleteSnapshot(r.Context(), a.DB); err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// cloneNamespace swagger:route POST /api/v1/namespace/pavedroad.io/clone namespaces clonenamespace
+//
+// Copy users, optionally filtered, into a new namespace.  With freshUUIDs
+// set records get new UUIDs and references to the old UUIDs are remapped.
+// Masks are applied to the copies, the source is not changed
+//
+// Responses:
+//    default: genericError
+//        201: cloneResult
+//        400: genericError
+//        403: genericError
+//        409: genericError
+func (a *UsersApp) cloneNamespace(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	req := cloneRequest{}
+
+	htmlData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := json.Unmarshal(htmlData, &req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// The path names the source, the target is checked here
+	if req.Target != "" {
+		if reason := authorize(r, VerbCreate, req.Target); reason != "" {
+			respondWithError(w, http.StatusForbidden, reason)
+			return
+		}
+	}
+
+	result, err := cloneNamespace(r.Context(), a.DB, vars["namespace"], req)
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, result)
+}
+
+// exportUsers swagger:route POST /api/v1/namespace/pavedroad.io/usersEXPORT users exportusers
+//
+// Export users as NDJSON, one document per line.  Columns can be masked
+// using redact, hash, tokenize, shuffle, or fake
+//
+// Responses:
+//    default: genericError
+//        200: usersExport
+//        400: genericError
+func (a *UsersApp) exportUsers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	req := exportRequest{}
+
+	htmlData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// An empty body exports everything unmasked
+	if len(htmlData) > 0 {
+		if err := json.Unmarshal(htmlData, &req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+
+	docs, err := exportNamespace(r.Context(), a.DB, vars["namespace"], req)
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	for _, d := range docs {
+		if err := enc.Encode(d); err != nil {
+			slog.ErrorContext(r.Context(), "Response failed", "error", err)
+			return
+		}
+	}
+}
+
+// getUsersChild swagger:route GET /api/v1/namespace/pavedroad.io/users/{key}/metadata users getuserschild
+//
+// Returns one child table of a users, i.e. metadata or metadata/test
+//
+// Responses:
+//    default: genericError
+//        200: usersResponse
+//        404: genericError
+func (a *UsersApp) getUsersChild(path []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		c := usersChild{path: path}
+
+		if err := c.getUsersChild(r.Context(), a.DB, vars["namespace"], vars["key"]); err != nil {
+			respondWithModelError(w, err)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, c.Body)
+	}
+}
+
+// updateUsersChild swagger:route PUT /api/v1/namespace/pavedroad.io/users/{key}/metadata users updateuserschild
+//
+// Replace one child table of a users atomically.  PATCH merges the keys
+// in the body into the child instead of replacing it
+//
+// Responses:
+//    default: genericError
+//        200: usersResponse
+//        400: genericError
+//        404: genericError
+//        507: genericError
+func (a *UsersApp) updateUsersChild(path []string, merge bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		c := usersChild{path: path}
+
+		htmlData, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		c.Body = htmlData
+
+		if err := c.updateUsersChild(r.Context(), a.DB, vars["namespace"], vars["key"], merge); err != nil {
+			respondWithModelError(w, err)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, c.Body)
+	}
+}
+
+// getConfigVersion swagger:route GET /admin/config admin getconfigversion
+//
+// Returns the version of the active configuration, admins only
+//
+// Responses:
+//    default: genericError
+//        200: configVersion
+//        403: genericError
+func (a *UsersApp) getConfigVersion(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	ac := active.Load()
+	if ac == nil {
+		ac = setConfig(defaultConfig())
+	}
+
+	respondWithJSON(w, http.StatusOK, configVersion{
+		Version:         ac.version,
+		Loaded:          ac.loaded,
+		Checksum:        ac.checksum,
+		RestartRequired: ac.pending,
+	})
+}
+
+// createAPIKey swagger:route POST /admin/apikeys admin createapikey
+//
+// Create an API key bound to namespaces and verbs.  The key is only
+// returned in this response
+//
+// Responses:
+//    default: genericError
+//        201: apiKey
+//        400: genericError
+//        403: genericError
+func (a *UsersApp) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	req := apiKeyRequest{}
+	htmlData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := json.Unmarshal(htmlData, &req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	k, err := createAPIKey(r.Context(), a.DB, req)
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "API key created", "key", k.ID, "name", k.Name)
+	respondWithJSON(w, http.StatusCreated, k)
+}
+
+// listAPIKeys swagger:route GET /admin/apikeys admin listapikeys
+//
+// Returns every API key without its secret
+//
+// Responses:
+//    default: genericError
+//        200: apiKeyList
+//        403: genericError
+func (a *UsersApp) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	kl, err := listAPIKeys(r.Context(), a.DB)
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, kl)
+}
+
+// revokeAPIKey swagger:route DELETE /admin/apikeys/{id} admin revokeapikey
+//
+// Revoke an API key, it is refused from then on
+//
+// Responses:
+//    default: genericError
+//        200: apiKey
+//        403: genericError
+//        404: genericError
+func (a *UsersApp) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	k, err := revokeAPIKey(r.Context(), a.DB, mux.Vars(r)["id"])
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "API key revoked", "key", k.ID, "name", k.Name)
+	respondWithJSON(w, http.StatusOK, k)
+}
+
+// canI swagger:route GET /admin/can-i admin cani
+//
+// Explains whether an identity can do a verb in a namespace, the caller
+// by default.  Only admins can ask about other identities
+//
+// Responses:
+//    default: genericError
+//        200: accessDecision
+//        400: genericError
+//        403: genericError
+func (a *UsersApp) canI(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	verb, namespace := q.Get("verb"), q.Get("namespace")
+
+	if !contains(verbs, verb) && verb != VerbAdmin {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("verb %q must be one of %s, %s", verb, strings.Join(verbs, ", "), VerbAdmin))
+		return
+	}
+	if namespace != AllNamespaces && !namespaceRE.MatchString(namespace) {
+		respondWithError(w, http.StatusBadRequest, "invalid namespace: "+namespace)
+		return
+	}
+
+	self := AnonymousIdentity
+	if id, ok := identityFrom(r.Context()); ok {
+		self = id.Name
+	}
+	name := q.Get("identity")
+	if name == "" {
+		name = self
+	}
+	if name != self && !requireAdmin(w, r) {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, currentConfig().can(name, verb, namespace))
+}
+
+// listAudit swagger:route GET /admin/audit admin listaudit
+//
+// Returns changes to users records, newest first, filtered by namespace,
+// identity, key, since, and until.  Admins of a namespace can read its
+// entries, other queries need an admin
+//
+// Responses:
+//    default: genericError
+//        200: auditList
+//        400: genericError
+//        403: genericError
+func (a *UsersApp) listAudit(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAuditQuery(r.URL.Query())
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	if q.Namespace == "" || authorize(r, VerbAdmin, q.Namespace) != "" {
+		if !requireAdmin(w, r) {
+			return
+		}
+	}
+
+	el, err := listAudit(r.Context(), a.DB, q)
+	if err != nil {
+		respondWithModelError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, el)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -363,27 +1026,34 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.WriteHeader(code)
 	_, err := w.Write(response)
 	if err != nil {
-		log.Printf("Response errror: %s", err)
+		slog.Error("Response failed", "error", err, "request_id", w.Header().Get(RequestIDHeader))
 	}
 
 }
 
-func logRequest(handler http.Handler) http.Handler {
+// timeoutMiddleware bounds each request, and the queries it runs, by
+// http.requestTimeout as configured when the request started
+func timeoutMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
-		handler.ServeHTTP(w, r)
+		ctx, cancel := context.WithTimeout(r.Context(), currentConfig().HTTP.RequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func openLogFile(logfile string) {
-	if logfile != "" {
-		lf, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+// openLogFile returns the log destination, stderr when logfile is empty
+func openLogFile(logfile string) io.Writer {
+	if logfile == "" {
+		return os.Stderr
+	}
 
-		if err != nil {
-			log.Fatal("OpenLogfile: os.OpenFile:", err)
-		}
-		log.SetOutput(lf)
+	lf, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "OpenLogfile: os.OpenFile:", err)
+		os.Exit(1)
 	}
+
+	return lf
 }
 
 /*
@@ -0,0 +1,346 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Actions recorded in the audit log
+const (
+	// AuditCreate a record was added, including by clone
+	AuditCreate string = "create"
+	// AuditUpdate a record or one of its child tables was changed
+	AuditUpdate string = "update"
+	// AuditDelete a record was removed
+	AuditDelete string = "delete"
+	// AuditRestore a record was replaced, added, or removed by a
+	// snapshot restore
+	AuditRestore string = "restore"
+)
+
+// Limits on the number of entries one audit query returns
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditEntry is one change to one users record.  Entries are only ever
+// inserted, in the transaction that made the change
+//
+// swagger:model auditEntry
+type auditEntry struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Namespace: of the record
+	Namespace string `json:"namespace"`
+	// Key: the UUID of the record
+	Key string `json:"key"`
+	// Action: create, update, delete, or restore
+	Action string `json:"action"`
+	// Identity: the caller, anonymous without credentials
+	Identity string `json:"identity"`
+	// Method: how the caller was authenticated, empty for anonymous
+	Method    string `json:"method"`
+	Client    string `json:"client"`
+	UserAgent string `json:"userAgent"`
+	RequestID string `json:"requestID"`
+	// Before: the record before the change, absent on create
+	Before json.RawMessage `json:"before,omitempty"`
+	// After: the record after the change, absent on delete
+	After json.RawMessage `json:"after,omitempty"`
+	// Diff: the fields that changed
+	Diff []auditChange `json:"diff"`
+}
+
+// auditChange is a field that was added, removed, or replaced
+//
+// swagger:model auditChange
+type auditChange struct {
+	// Path: JSON pointer to the field
+	Path string `json:"path"`
+	// Op: add, remove, or replace
+	Op   string      `json:"op"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// auditList is returned by GET /admin/audit
+//
+// swagger:response auditList
+type auditList struct {
+	// in: body
+	Body []auditEntry
+}
+
+// auditQuery filters the audit log, empty fields match everything
+type auditQuery struct {
+	Namespace string
+	Identity  string
+	Key       string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// clientKey stores the client of a request in its context
+type clientKey struct{}
+
+// auditClient is the caller's address and user agent
+type auditClient struct {
+	Address   string
+	UserAgent string
+}
+
+// auditMiddleware records the client of each request for the audit log
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		address, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			address = r.RemoteAddr
+		}
+
+		ctx := context.WithValue(r.Context(), clientKey{}, auditClient{Address: address, UserAgent: r.UserAgent()})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// auditMetadata returns the occurred, identity, method, client,
+// userAgent, and requestID columns for changes made by ctx
+func auditMetadata(ctx context.Context) []interface{} {
+	name, method := AnonymousIdentity, ""
+	if id, ok := identityFrom(ctx); ok {
+		name, method = id.Name, id.Method
+	}
+	client, _ := ctx.Value(clientKey{}).(auditClient)
+
+	return []interface{}{time.Now().UTC(), name, method, client.Address, client.UserAgent, requestID(ctx)}
+}
+
+// nullJSON stores a missing document as NULL
+func nullJSON(jb []byte) interface{} {
+	if jb == nil {
+		return nil
+	}
+	return jb
+}
+
+// recordAudit adds an entry for a change made inside tx
+func recordAudit(ctx context.Context, tx *sql.Tx, action, namespace, key string, before, after []byte) error {
+	statement := `
+  INSERT INTO Acme.usersAudit(occurred, identity, method, client, userAgent, requestID,
+    namespace, UsersUUID, action, beforeDoc, afterDoc)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);`
+
+	args := append(auditMetadata(ctx), namespace, key, action, nullJSON(before), nullJSON(after))
+	if _, err := tx.ExecContext(ctx, statement, args...); err != nil {
+		slog.ErrorContext(ctx, "Audit insert failed", "key", key, "action", action, "error", err)
+		return err
+	}
+	return nil
+}
+
+// readUsersDocument returns the stored record locked for the rest of
+// tx, or nil when it does not exist
+func readUsersDocument(ctx context.Context, tx *sql.Tx, namespace, key string) ([]byte, error) {
+	var jb []byte
+	statement := `SELECT users FROM Acme.users WHERE namespace = $1 AND UsersUUID = $2 FOR UPDATE;`
+	err := tx.QueryRowContext(ctx, statement, namespace, key).Scan(&jb)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return jb, err
+}
+
+// parseAuditQuery reads the namespace, identity, key, since, until, and
+// limit parameters
+func parseAuditQuery(v url.Values) (auditQuery, error) {
+	q := auditQuery{
+		Namespace: v.Get("namespace"),
+		Identity:  v.Get("identity"),
+		Key:       v.Get("key"),
+		Limit:     defaultAuditLimit,
+	}
+
+	if q.Namespace != "" && !namespaceRE.MatchString(q.Namespace) {
+		return q, errInvalid("invalid namespace: %s", q.Namespace)
+	}
+	if q.Key != "" {
+		if _, err := uuid.Parse(q.Key); err != nil {
+			return q, errInvalidUUID(q.Key)
+		}
+	}
+
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := v.Get(name); s != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return q, errInvalid("%s must be an RFC 3339 time: %s", name, s)
+			}
+			*t = parsed
+		}
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Until.After(q.Since) {
+		return q, errInvalid("until must be after since")
+	}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			return q, errInvalid("limit must be between 1 and %d", maxAuditLimit)
+		}
+		q.Limit = n
+	}
+
+	return q, nil
+}
+
+// listAudit returns matching entries, newest first.  since is inclusive
+// and until exclusive so the time of the last entry can page back
+func listAudit(ctx context.Context, db *sql.DB, q auditQuery) ([]auditEntry, error) {
+	defer observeDB(ctx, "listAudit")()
+
+	var where []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(condition, len(args)))
+	}
+
+	if q.Namespace != "" {
+		add("namespace = $%d", q.Namespace)
+	}
+	if q.Identity != "" {
+		add("identity = $%d", q.Identity)
+	}
+	if q.Key != "" {
+		add("UsersUUID = $%d", q.Key)
+	}
+	if !q.Since.IsZero() {
+		add("occurred >= $%d", q.Since)
+	}
+	if !q.Until.IsZero() {
+		add("occurred < $%d", q.Until)
+	}
+
+	statement := `
+  SELECT id, occurred, namespace, UsersUUID, action, identity, method, client,
+    userAgent, requestID, beforeDoc, afterDoc
+  FROM Acme.usersAudit`
+	if len(where) > 0 {
+		statement += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	args = append(args, q.Limit)
+	statement += fmt.Sprintf(` ORDER BY occurred DESC, id LIMIT $%d;`, len(args))
+
+	rows, err := db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	el := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.Time, &e.Namespace, &e.Key, &e.Action, &e.Identity,
+			&e.Method, &e.Client, &e.UserAgent, &e.RequestID, &before, &after); err != nil {
+			slog.ErrorContext(ctx, "SQL rows.Scan failed", "error", err)
+			return el, err
+		}
+		e.Before, e.After = before, after
+		if e.Diff, err = diffDocuments(before, after); err != nil {
+			return el, err
+		}
+		el = append(el, e)
+	}
+
+	return el, rows.Err()
+}
+
+// diffDocuments compares two stored records, either may be nil
+func diffDocuments(before, after []byte) ([]auditChange, error) {
+	var b, a interface{}
+	if before != nil {
+		if err := json.Unmarshal(before, &b); err != nil {
+			return nil, err
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal(after, &a); err != nil {
+			return nil, err
+		}
+	}
+
+	// Created and deleted records list every field
+	if b == nil {
+		b = map[string]interface{}{}
+	}
+	if a == nil {
+		a = map[string]interface{}{}
+	}
+
+	return diffValues("", b, a, []auditChange{}), nil
+}
+
+// diffValues appends the changes from before to after at path.  Objects
+// are compared field by field, anything else as a whole
+func diffValues(path string, before, after interface{}, changes []auditChange) []auditChange {
+	bm, bok := before.(map[string]interface{})
+	am, aok := after.(map[string]interface{})
+	if !bok || !aok {
+		if !reflect.DeepEqual(before, after) {
+			changes = append(changes, auditChange{Path: path, Op: "replace", From: before, To: after})
+		}
+		return changes
+	}
+
+	fields := make([]string, 0, len(bm)+len(am))
+	for f := range bm {
+		fields = append(fields, f)
+	}
+	for f := range am {
+		if _, ok := bm[f]; !ok {
+			fields = append(fields, f)
+		}
+	}
+	sort.Strings(fields)
+
+	// JSON pointer escaping, RFC 6901
+	escape := strings.NewReplacer("~", "~0", "/", "~1")
+	for _, f := range fields {
+		p := path + "/" + escape.Replace(f)
+		bv, inBefore := bm[f]
+		av, inAfter := am[f]
+		switch {
+		case !inBefore:
+			changes = append(changes, auditChange{Path: p, Op: "add", To: av})
+		case !inAfter:
+			changes = append(changes, auditChange{Path: p, Op: "remove", From: bv})
+		default:
+			changes = diffValues(p, bv, av, changes)
+		}
+	}
+	return changes
+}
@@ -0,0 +1,408 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Verbs name what a request does to a namespace
+const (
+	VerbGet    string = "get"
+	VerbList   string = "list"
+	VerbCreate string = "create"
+	VerbUpdate string = "update"
+	VerbDelete string = "delete"
+)
+
+// verbs lists every verb in the order they are documented
+var verbs = []string{VerbGet, VerbList, VerbCreate, VerbUpdate, VerbDelete}
+
+// minJWTSecretLength is the shortest HS256 secret accepted, RFC 7518
+// asks for a key at least as long as the hash
+const minJWTSecretLength = 32
+
+// jwtMethods are the signing algorithms accepted in bearer tokens
+var jwtMethods = []string{"RS256", "ES256", "HS256"}
+
+// enabled reports whether bearer tokens are accepted
+func (jc jwtConfig) enabled() bool {
+	return jc.JWKSFile != "" || jc.KeyFile != "" || jc.Secret != ""
+}
+
+// jwtVerifier checks bearer tokens against the configured keys, a new
+// one replaces it on reload
+type jwtVerifier struct {
+	// keys by kid, a key without a kid is stored under ""
+	keys   map[string]interface{}
+	parser *jwt.Parser
+	claim  string
+}
+
+// newJWTVerifier reads the keys, it returns nil when bearer tokens are
+// not configured
+func newJWTVerifier(jc jwtConfig) (*jwtVerifier, error) {
+	if !jc.enabled() {
+		return nil, nil
+	}
+
+	v := &jwtVerifier{
+		keys:  map[string]interface{}{},
+		claim: jc.IdentityClaim,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(jwtMethods),
+			jwt.WithIssuer(jc.Issuer),
+			jwt.WithAudience(jc.Audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(jc.Leeway),
+		),
+	}
+
+	var err error
+	switch {
+	case jc.JWKSFile != "":
+		v.keys, err = readJWKS(jc.JWKSFile)
+	case jc.KeyFile != "":
+		v.keys[""], err = readPublicKey(jc.KeyFile)
+	default:
+		v.keys[""] = []byte(jc.Secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// verify validates token and returns the identity it names
+func (v *jwtVerifier) verify(token string) (string, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return "", err
+	}
+
+	name, _ := claims[v.claim].(string)
+	if name == "" {
+		return "", fmt.Errorf("token has no %s claim", v.claim)
+	}
+	return name, nil
+}
+
+// key finds the key named by the token's kid and checks that it is
+// meant for the token's algorithm, so an RSA public key is never used
+// as an HMAC secret
+func (v *jwtVerifier) key(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	key, ok := v.keys[kid]
+	if !ok && kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	if alg := keyAlgorithm(key); alg != t.Method.Alg() {
+		return nil, fmt.Errorf("key %q is for %s, not %s", kid, alg, t.Method.Alg())
+	}
+	return key, nil
+}
+
+// keyAlgorithm returns the signing algorithm a key is used with
+func keyAlgorithm(key interface{}) string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RS256"
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return "ES256"
+		}
+	case []byte:
+		return "HS256"
+	}
+	return ""
+}
+
+// readPublicKey reads a PEM public key or the key of a PEM certificate
+func readPublicKey(path string) (interface{}, error) {
+	pb, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pb)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM type %s", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if keyAlgorithm(key) == "" {
+		return nil, fmt.Errorf("%s: key must be RSA or EC P-256", path)
+	}
+	return key, nil
+}
+
+// jsonWebKey is the subset of RFC 7517 used to verify signatures
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// readJWKS reads a JSON Web Key Set, keys not used for signatures are
+// skipped
+func readJWKS(path string) (map[string]interface{}, error) {
+	jb, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(jb, &set); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	keys := map[string]interface{}{}
+	for i, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if _, dup := keys[jwk.Kid]; dup {
+			return nil, fmt.Errorf("%s: duplicate kid %q", path, jwk.Kid)
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d: %s", path, i, err)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no signing keys found", path)
+	}
+	return keys, nil
+}
+
+// publicKey decodes the key material
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeJWKInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.K, "="))
+		if err != nil {
+			return nil, err
+		}
+		if len(k) < minJWTSecretLength {
+			return nil, fmt.Errorf("oct key must be at least %d bytes", minJWTSecretLength)
+		}
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("unsupported kty %q", jwk.Kty)
+}
+
+// decodeJWKInt decodes a base64url big-endian integer
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// initializeAuth reads the keys used to verify bearer tokens
+func (a *UsersApp) initializeAuth() error {
+	v, err := newJWTVerifier(currentConfig().Auth.JWT)
+	if err != nil {
+		return err
+	}
+	a.jwt.Store(v)
+	return nil
+}
+
+// requestVerb maps a request to a verb.  Reads without a key or name
+// are lists; POSTs that only read, like export, are not creates
+func requestVerb(r *http.Request) string {
+	vars := mux.Vars(r)
+	path := r.URL.Path
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if vars["key"] == "" && vars["name"] == "" {
+			return VerbList
+		}
+		return VerbGet
+	case http.MethodPost:
+		switch {
+		case strings.HasSuffix(path, UsersResourceType+"EXPORT"),
+			strings.HasSuffix(path, "/clone"):
+			// Clone also needs create in the target, see cloneNamespace
+			return VerbList
+		case strings.HasSuffix(path, UsersResourceType+"SCHEMA"):
+			return VerbGet
+		case strings.HasSuffix(path, "/restore"):
+			return VerbUpdate
+		}
+		return VerbCreate
+	case http.MethodPut, http.MethodPatch:
+		return VerbUpdate
+	case http.MethodDelete:
+		return VerbDelete
+	}
+	return ""
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+// protectedPath reports whether anonymous callers can be refused,
+// probes and metrics stay open
+func protectedPath(path string) bool {
+	return strings.HasPrefix(path, UsersAPIVersion+"/") || strings.HasPrefix(path, AdminPath+"/")
+}
+
+// respondUnauthorized answers 401 with a WWW-Authenticate challenge
+func respondUnauthorized(w http.ResponseWriter, challenge, message string) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondWithError(w, http.StatusUnauthorized, message)
+}
+
+// authMiddleware sets the identity of callers with a valid bearer
+// token or API key.  Invalid credentials are always refused, missing
+// ones only when auth.anonymous is false
+func (a *UsersApp) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := bearerToken(r); ok {
+			v := a.jwt.Load()
+			if v == nil {
+				respondUnauthorized(w, `Bearer error="invalid_token"`, "bearer tokens are not accepted")
+				return
+			}
+
+			name, err := v.verify(token)
+			if err != nil {
+				slog.WarnContext(r.Context(), "Bearer token rejected", "error", err)
+				respondUnauthorized(w, `Bearer error="invalid_token"`, "invalid bearer token")
+				return
+			}
+
+			r = r.WithContext(withIdentity(r.Context(), identity{Name: name, Method: AuthJWT}))
+		} else if presented := r.Header.Get(APIKeyHeader); presented != "" {
+			k, err := authenticateAPIKey(r.Context(), a.DB, presented)
+			if storeUnavailable(err) {
+				respondWithModelError(w, err)
+				return
+			}
+			if err != nil {
+				slog.WarnContext(r.Context(), "API key rejected", "error", err)
+				respondUnauthorized(w, "ApiKey", "invalid API key")
+				return
+			}
+
+			if reason := apiKeyScope(r, k); reason != "" {
+				respondWithError(w, http.StatusForbidden, reason)
+				return
+			}
+			r = r.WithContext(withIdentity(r.Context(), identity{Name: k.Name, Method: AuthAPIKey, key: k}))
+		}
+
+		if _, ok := identityFrom(r.Context()); !ok && !currentConfig().Auth.Anonymous && protectedPath(r.URL.Path) {
+			respondUnauthorized(w, "Bearer", "authentication required")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
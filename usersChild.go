@@ -0,0 +1,187 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// usersChildTables are the tables from testDataMgr.yaml with a
+// parent-tables entry, each one is a path in the users document named
+// by the JSON keys of the users model
+var usersChildTables = [][]string{
+	{"Metadata"},
+	{"Metadata", "Test"},
+}
+
+// usersChild is a subtree of a users document such as metadata
+type usersChild struct {
+	path []string
+	Body json.RawMessage
+}
+
+// childSelect reads the whole record, keys are matched in Go
+const childSelect = `
+  SELECT users
+  FROM Acme.users
+  WHERE namespace = $1 AND UsersUUID = $2;`
+
+// childUpdate stores the record with the changed subtree
+const childUpdate = `
+  UPDATE Acme.users
+  SET users = $3
+  WHERE namespace = $1 AND UsersUUID = $2;`
+
+// name returns the child path as used in routes and messages, i.e.
+// metadata/test
+func (c *usersChild) name() string {
+	return strings.ToLower(strings.Join(c.path, "/"))
+}
+
+// childKey returns the key of obj that matches name ignoring case, like
+// encoding/json does, or name when there is none
+func childKey(obj map[string]interface{}, name string) string {
+	if _, ok := obj[name]; ok {
+		return name
+	}
+	for k := range obj {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
+
+// locate returns the object holding the subtree and the key of the
+// subtree in it, the object is nil when a parent is not an object
+func (c *usersChild) locate(doc map[string]interface{}) (map[string]interface{}, string) {
+	obj := doc
+	for _, p := range c.path[:len(c.path)-1] {
+		next, ok := obj[childKey(obj, p)].(map[string]interface{})
+		if !ok {
+			return nil, ""
+		}
+		obj = next
+	}
+	return obj, childKey(obj, c.path[len(c.path)-1])
+}
+
+// parentMissing reports a record without the parent of the subtree
+func (c *usersChild) parentMissing(key string) error {
+	parent := &usersChild{path: c.path[:len(c.path)-1]}
+	return errNotFound("%s is not set for %s", parent.name(), key)
+}
+
+// getUsersChild reads the subtree of the users record with key
+func (c *usersChild) getUsersChild(ctx context.Context, db *sql.DB, namespace, key string) error {
+	defer observeDB(ctx, "getUsersChild")()
+
+	if _, err := uuid.Parse(key); err != nil {
+		return errInvalidUUID(key)
+	}
+
+	var jb []byte
+	err := db.QueryRowContext(ctx, childSelect, namespace, key).Scan(&jb)
+	if err == sql.ErrNoRows {
+		return errNotFound("%s does not exist", key)
+	}
+	if err != nil {
+		return err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(jb, &doc); err != nil {
+		return err
+	}
+
+	obj, k := c.locate(doc)
+	if obj == nil {
+		return c.parentMissing(key)
+	}
+	if obj[k] == nil {
+		return errNotFound("%s is not set for %s", c.name(), key)
+	}
+
+	c.Body, err = json.Marshal(obj[k])
+	return err
+}
+
+// updateUsersChild replaces the subtree, or merges into it when merge
+// is true, and stores the resulting subtree in Body.  The parent object
+// must exist
+func (c *usersChild) updateUsersChild(ctx context.Context, db *sql.DB, namespace, key string, merge bool) error {
+	defer observeDB(ctx, "updateUsersChild")()
+
+	if _, err := uuid.Parse(key); err != nil {
+		return errInvalidUUID(key)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(c.Body, &body); err != nil || body == nil {
+		return errInvalid("%s must be a JSON object", c.name())
+	}
+
+	var child []byte
+	err := runInTx(ctx, db, "updateUsersChild", func(tx *sql.Tx) error {
+		before, err := readUsersDocument(ctx, tx, namespace, key)
+		if err != nil {
+			return err
+		}
+		if before == nil {
+			return errNotFound("%s does not exist", key)
+		}
+
+		var doc map[string]interface{}
+		if err := json.Unmarshal(before, &doc); err != nil {
+			return err
+		}
+
+		obj, k := c.locate(doc)
+		if obj == nil {
+			return c.parentMissing(key)
+		}
+
+		value := body
+		if existing, ok := obj[k].(map[string]interface{}); ok && merge {
+			for f, v := range body {
+				existing[childKey(existing, f)] = v
+			}
+			value = existing
+		}
+		obj[k] = value
+		doc[childKey(doc, "updated")] = time.Now().UTC()
+
+		after, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if err := checkDocumentSize(after); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, childUpdate, namespace, key, after); err != nil {
+			return err
+		}
+		if child, err = json.Marshal(value); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditUpdate, namespace, key, before, after)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Body = child
+	return nil
+}
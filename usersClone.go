@@ -0,0 +1,269 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// namespaceRE limits new namespace names to URL friendly values
+var namespaceRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// cloneRequest is the body of a clone call
+//
+// swagger:model cloneRequest
+type cloneRequest struct {
+	// Target: the new namespace, it must not contain any users
+	Target string `json:"target"`
+	// Filter: optional JSON document, only users containing it are copied
+	Filter map[string]interface{} `json:"filter"`
+	// FreshUUIDs: assign new UUIDs and remap references to them
+	FreshUUIDs bool `json:"freshUUIDs"`
+	// Masks: masking policy by column path, i.e. {"id": "tokenize"}
+	Masks map[string]string `json:"masks"`
+	// MaskKey: secret used by hash, tokenize, and fake so results are
+	// consistent between requests
+	MaskKey string `json:"maskKey"`
+}
+
+// exportRequest is the body of an export call
+//
+// swagger:model exportRequest
+type exportRequest struct {
+	// Filter: optional JSON document, only users containing it are exported
+	Filter map[string]interface{} `json:"filter"`
+	// Masks: masking policy by column path, i.e. {"id": "tokenize"}
+	Masks map[string]string `json:"masks"`
+	// MaskKey: secret used by hash, tokenize, and fake so results are
+	// consistent between requests
+	MaskKey string `json:"maskKey"`
+}
+
+// cloneResult is returned after a namespace was cloned
+//
+// swagger:model cloneResult
+type cloneResult struct {
+	// Source: namespace that was copied
+	Source string `json:"source"`
+	// Target: namespace that was created
+	Target string `json:"target"`
+	// Records: number of users copied
+	Records int `json:"records"`
+	// UUIDs: old to new UUID mapping when FreshUUIDs was set
+	UUIDs map[string]string `json:"uuids,omitempty"`
+}
+
+// sqlQueryer is implemented by both sql.DB and sql.Tx
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// clonedRecord is one users record read from a namespace
+type clonedRecord struct {
+	uid string
+	doc interface{}
+}
+
+// cloneNamespace copies users from source into a new namespace
+// in a single transaction
+func cloneNamespace(ctx context.Context, db *sql.DB, source string, req cloneRequest) (cloneResult, error) {
+	defer observeDB(ctx, "cloneNamespace")()
+
+	result := cloneResult{Source: source, Target: req.Target}
+
+	if !namespaceRE.MatchString(req.Target) {
+		return result, errInvalid("invalid target namespace: %s", req.Target)
+	}
+	if req.Target == source {
+		return result, errInvalid("target must differ from %s", source)
+	}
+
+	m, err := newMasker(req.Masks, req.MaskKey)
+	if err != nil {
+		return result, errInvalid("%s", err)
+	}
+
+	err = runInTx(ctx, db, "cloneNamespace", func(tx *sql.Tx) error {
+		// Start over when the transaction is retried
+		result = cloneResult{Source: source, Target: req.Target}
+		return cloneRecords(ctx, tx, m, source, req, &result)
+	})
+
+	return result, err
+}
+
+// cloneRecords copies the records inside tx and fills in result
+func cloneRecords(ctx context.Context, tx *sql.Tx, m *masker, source string, req cloneRequest, result *cloneResult) error {
+	var existing int
+	count := `SELECT count(*) FROM Acme.users WHERE namespace = $1;`
+	if err := tx.QueryRowContext(ctx, count, req.Target).Scan(&existing); err != nil {
+		return err
+	}
+	if existing > 0 {
+		return errConflict("namespace %s is not empty", req.Target)
+	}
+
+	records, err := readNamespaceRecords(ctx, tx, source, req.Filter)
+	if err != nil {
+		return err
+	}
+
+	if req.FreshUUIDs {
+		result.UUIDs = map[string]string{}
+		for _, rec := range records {
+			result.UUIDs[rec.uid] = uuid.New().String()
+		}
+	}
+
+	// References are remapped before masking can change them
+	docs := make([]interface{}, len(records))
+	for i, rec := range records {
+		docs[i] = rec.doc
+		if req.FreshUUIDs {
+			docs[i] = remapUUIDs(rec.doc, result.UUIDs)
+		}
+	}
+	m.apply(docs)
+
+	if err := checkRecordQuota(ctx, tx, req.Target, len(records)); err != nil {
+		return err
+	}
+
+	insert := `INSERT INTO Acme.users(namespace, UsersUUID, users) VALUES ($1, $2, $3);`
+	for i, rec := range records {
+		uid := rec.uid
+		if req.FreshUUIDs {
+			uid = result.UUIDs[rec.uid]
+		}
+
+		jb, err := json.Marshal(docs[i])
+		if err != nil {
+			return err
+		}
+		if err := checkDocumentSize(jb); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, insert, req.Target, uid, jb); err != nil {
+			slog.ErrorContext(ctx, "Clone insert failed", "key", uid, "error", err)
+			return err
+		}
+		if err := recordAudit(ctx, tx, AuditCreate, req.Target, uid, nil, jb); err != nil {
+			return err
+		}
+		result.Records++
+	}
+
+	return nil
+}
+
+// exportNamespace returns the masked users documents of a namespace
+// with UsersUUID set to the key of each record
+func exportNamespace(ctx context.Context, db *sql.DB, namespace string, req exportRequest) ([]interface{}, error) {
+	defer observeDB(ctx, "exportNamespace")()
+
+	m, err := newMasker(req.Masks, req.MaskKey)
+	if err != nil {
+		return nil, errInvalid("%s", err)
+	}
+
+	records, err := readNamespaceRecords(ctx, db, namespace, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]interface{}, len(records))
+	for i, rec := range records {
+		if obj, ok := rec.doc.(map[string]interface{}); ok {
+			for k := range obj {
+				if strings.EqualFold(k, "UsersUUID") {
+					delete(obj, k)
+				}
+			}
+			obj["UsersUUID"] = rec.uid
+		}
+		docs[i] = rec.doc
+	}
+	m.apply(docs)
+
+	return docs, nil
+}
+
+// readNamespaceRecords returns the users in a namespace, optionally only
+// those whose document contains filter
+func readNamespaceRecords(ctx context.Context, q sqlQueryer, namespace string, filter map[string]interface{}) ([]clonedRecord, error) {
+	var rows *sql.Rows
+	var err error
+
+	if len(filter) > 0 {
+		fb, err := json.Marshal(filter)
+		if err != nil {
+			return nil, err
+		}
+		statement := `SELECT UsersUUID, users FROM Acme.users WHERE namespace = $1 AND users @> $2;`
+		rows, err = q.QueryContext(ctx, statement, namespace, fb)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		statement := `SELECT UsersUUID, users FROM Acme.users WHERE namespace = $1;`
+		rows, err = q.QueryContext(ctx, statement, namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	defer rows.Close()
+
+	records := []clonedRecord{}
+	for rows.Next() {
+		var rec clonedRecord
+		var jb []byte
+		if err := rows.Scan(&rec.uid, &jb); err != nil {
+			slog.ErrorContext(ctx, "SQL rows.Scan failed", "error", err)
+			return nil, err
+		}
+		if err := json.Unmarshal(jb, &rec.doc); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+
+	return records, rows.Err()
+}
+
+// remapUUIDs replaces every string equal to an old UUID with the new one
+// so references between records follow the copied records
+func remapUUIDs(v interface{}, mapping map[string]string) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, e := range val {
+			val[k] = remapUUIDs(e, mapping)
+		}
+		return val
+	case []interface{}:
+		for i, e := range val {
+			val[i] = remapUUIDs(e, mapping)
+		}
+		return val
+	case string:
+		if n, ok := mapping[strings.ToLower(val)]; ok {
+			return n
+		}
+		return val
+	}
+	return v
+}
@@ -0,0 +1,721 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings are applied in this order, later sources win:
+//
+//	defaults, the YAML file, environment variables, flags
+const (
+	// ConfigFileFlag names the YAML configuration file
+	ConfigFileFlag string = "config"
+	// ConfigFileEnv names the YAML configuration file when the flag is not set
+	ConfigFileEnv string = "APP_CONFIG_FILE"
+)
+
+// redacted replaces secret values in config dump
+const redacted string = "REDACTED"
+
+// usersConfig is the complete service configuration
+type usersConfig struct {
+	Database  databaseConfig  `yaml:"database"`
+	HTTP      httpConfig      `yaml:"http"`
+	TLS       tlsConfig       `yaml:"tls"`
+	Auth      authConfig      `yaml:"auth"`
+	RBAC      rbacConfig      `yaml:"rbac"`
+	Log       logConfig       `yaml:"log"`
+	Trace     traceConfig     `yaml:"trace"`
+	Limits    limitsConfig    `yaml:"limits"`
+	Generator generatorConfig `yaml:"generator"`
+}
+
+// defaultConfig is used for settings no source provides
+func defaultConfig() usersConfig {
+	return usersConfig{
+		Database: databaseConfig{
+			Username: "root",
+			Database: "pavedroad",
+			SSLMode:  "disable",
+			Driver:   "postgres",
+			Host:     "127.0.0.1",
+			Port:     26257,
+			Pool: poolConfig{
+				MaxOpenConns:    25,
+				MaxIdleConns:    25,
+				ConnMaxLifetime: 5 * time.Minute,
+			},
+			TxRetries:      5,
+			StartupTimeout: 60 * time.Second,
+			Breaker: breakerConfig{
+				Failures: 5,
+				Cooldown: 10 * time.Second,
+			},
+		},
+		HTTP: httpConfig{
+			Host:            "127.0.0.1",
+			Port:            8082,
+			ShutdownTimeout: 15 * time.Second,
+			ReadTimeout:     60 * time.Second,
+			WriteTimeout:    60 * time.Second,
+			RequestTimeout:  30 * time.Second,
+		},
+		TLS: tlsConfig{
+			ClientAuth: ClientAuthNone,
+		},
+		Auth: authConfig{
+			Anonymous: true,
+			JWT: jwtConfig{
+				IdentityClaim: "sub",
+				Leeway:        30 * time.Second,
+			},
+		},
+		Log: logConfig{
+			Level: "info",
+			File:  "logs/users.log",
+		},
+		Trace: traceConfig{
+			Exporter:    TraceNone,
+			File:        "logs/users-trace.json",
+			SampleRatio: 1,
+		},
+		Limits: limitsConfig{
+			Burst: 20,
+		},
+		Generator: generatorConfig{
+			MaxCount:     defaultMaxGenerateCount,
+			StringLength: defaultStringLength,
+			TimeWindow:   defaultTimeWindow,
+		},
+	}
+}
+
+// configSetting is one value that can be set from the environment or a flag
+type configSetting struct {
+	// name is the YAML path, i.e. database.port
+	name  string
+	env   string
+	flag  string
+	usage string
+	// isBool lets the flag be given without a value
+	isBool bool
+	// secret values can also be read from the file named by env_FILE
+	// and are redacted by config dump
+	secret bool
+	set    func(c *usersConfig, v string) error
+}
+
+// configSettings lists every setting with an environment variable or flag.
+// Secrets have no flag so they do not show up in process listings
+var configSettings = []configSetting{
+	{name: "database.username", env: "APP_DB_USERNAME", flag: "db-user", usage: "Database user",
+		set: setString(func(c *usersConfig) *string { return &c.Database.Username })},
+	{name: "database.password", env: "APP_DB_PASSWORD", secret: true,
+		set: setString(func(c *usersConfig) *string { return &c.Database.Password })},
+	{name: "database.database", env: "APP_DB_NAME", flag: "db-name", usage: "Database name",
+		set: setString(func(c *usersConfig) *string { return &c.Database.Database })},
+	{name: "database.sslMode", env: "APP_DB_SSL_MODE", flag: "db-sslmode", usage: "Database sslmode",
+		set: setString(func(c *usersConfig) *string { return &c.Database.SSLMode })},
+	{name: "database.driver", env: "APP_DB_SQL_DRIVER", flag: "db-driver", usage: "database/sql driver",
+		set: setString(func(c *usersConfig) *string { return &c.Database.Driver })},
+	{name: "database.host", env: "APP_DB_IP", flag: "db-host", usage: "Database host",
+		set: setString(func(c *usersConfig) *string { return &c.Database.Host })},
+	{name: "database.port", env: "APP_DB_PORT", flag: "db-port", usage: "Database port",
+		set: setInt(func(c *usersConfig) *int { return &c.Database.Port })},
+	{name: "database.sslRootCert", env: "APP_DB_SSL_ROOT_CERT", flag: "db-sslrootcert", usage: "CA certificate of the database",
+		set: setString(func(c *usersConfig) *string { return &c.Database.SSLRootCert })},
+	{name: "database.sslCert", env: "APP_DB_SSL_CERT", flag: "db-sslcert", usage: "Client certificate for the database user",
+		set: setString(func(c *usersConfig) *string { return &c.Database.SSLCert })},
+	{name: "database.sslKey", env: "APP_DB_SSL_KEY", flag: "db-sslkey", usage: "Private key for db-sslcert",
+		set: setString(func(c *usersConfig) *string { return &c.Database.SSLKey })},
+	{name: "database.dsn", env: "APP_DB_DSN", secret: true,
+		set: setString(func(c *usersConfig) *string { return &c.Database.DSN })},
+	{name: "database.autoMigrate", env: "APP_DB_AUTO_MIGRATE", flag: "db-auto-migrate", usage: "Apply pending migrations on startup", isBool: true,
+		set: setBool(func(c *usersConfig) *bool { return &c.Database.AutoMigrate })},
+	{name: "database.pool.maxOpenConns", env: "APP_DB_MAX_OPEN_CONNS", flag: "db-max-open-conns", usage: "Maximum open database connections, 0 is unlimited",
+		set: setInt(func(c *usersConfig) *int { return &c.Database.Pool.MaxOpenConns })},
+	{name: "database.pool.maxIdleConns", env: "APP_DB_MAX_IDLE_CONNS", flag: "db-max-idle-conns", usage: "Maximum idle database connections",
+		set: setInt(func(c *usersConfig) *int { return &c.Database.Pool.MaxIdleConns })},
+	{name: "database.pool.connMaxLifetime", env: "APP_DB_CONN_MAX_LIFETIME", flag: "db-conn-max-lifetime", usage: "Close connections older than this, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.Database.Pool.ConnMaxLifetime })},
+	{name: "database.pool.connMaxIdleTime", env: "APP_DB_CONN_MAX_IDLE_TIME", flag: "db-conn-max-idle-time", usage: "Close connections idle this long, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.Database.Pool.ConnMaxIdleTime })},
+	{name: "database.txRetries", env: "APP_DB_TX_RETRIES", flag: "db-tx-retries", usage: "Retries of a write after a serialization failure",
+		set: setInt(func(c *usersConfig) *int { return &c.Database.TxRetries })},
+	{name: "database.startupTimeout", env: "APP_DB_STARTUP_TIMEOUT", flag: "db-startup-timeout", usage: "Wait this long for the database on startup, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.Database.StartupTimeout })},
+	{name: "database.breaker.failures", env: "APP_DB_BREAKER_FAILURES", flag: "db-breaker-failures", usage: "Store failures in a row that open the circuit breaker",
+		set: setInt(func(c *usersConfig) *int { return &c.Database.Breaker.Failures })},
+	{name: "database.breaker.cooldown", env: "APP_DB_BREAKER_COOLDOWN", flag: "db-breaker-cooldown", usage: "Time the circuit breaker stays open, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.Database.Breaker.Cooldown })},
+	{name: "http.host", env: "HTTP_IP_ADDR", flag: "http-host", usage: "Address to listen on",
+		set: setString(func(c *usersConfig) *string { return &c.HTTP.Host })},
+	{name: "http.port", env: "HTTP_IP_PORT", flag: "http-port", usage: "Port to listen on",
+		set: setInt(func(c *usersConfig) *int { return &c.HTTP.Port })},
+	{name: "http.readTimeout", env: "HTTP_READ_TIMEOUT", flag: "http-read-timeout", usage: "Request read timeout, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.HTTP.ReadTimeout })},
+	{name: "http.writeTimeout", env: "HTTP_WRITE_TIMEOUT", flag: "http-write-timeout", usage: "Response write timeout, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.HTTP.WriteTimeout })},
+	{name: "http.shutdownTimeout", env: "HTTP_SHUTDOWN_TIMEOUT", flag: "http-shutdown-timeout", usage: "Time allowed to drain on shutdown, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.HTTP.ShutdownTimeout })},
+	{name: "http.requestTimeout", env: "HTTP_REQUEST_TIMEOUT", flag: "http-request-timeout", usage: "Time allowed per request, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.HTTP.RequestTimeout })},
+	{name: "tls.certFile", env: "APP_TLS_CERT_FILE", flag: "tls-cert", usage: "PEM certificate, enables TLS",
+		set: setString(func(c *usersConfig) *string { return &c.TLS.CertFile })},
+	{name: "tls.keyFile", env: "APP_TLS_KEY_FILE", flag: "tls-key", usage: "PEM private key for tls-cert",
+		set: setString(func(c *usersConfig) *string { return &c.TLS.KeyFile })},
+	{name: "tls.clientCAFile", env: "APP_TLS_CLIENT_CA_FILE", flag: "tls-client-ca", usage: "PEM CA bundle for client certificates",
+		set: setString(func(c *usersConfig) *string { return &c.TLS.ClientCAFile })},
+	{name: "tls.clientAuth", env: "APP_TLS_CLIENT_AUTH", flag: "tls-client-auth", usage: "none, optional, or require",
+		set: setString(func(c *usersConfig) *string { return &c.TLS.ClientAuth })},
+	{name: "auth.anonymous", env: "APP_AUTH_ANONYMOUS", flag: "auth-anonymous", usage: "Allow API requests without credentials", isBool: true,
+		set: setBool(func(c *usersConfig) *bool { return &c.Auth.Anonymous })},
+	{name: "auth.admins", env: "APP_AUTH_ADMINS", flag: "auth-admins", usage: "Comma separated identities allowed to manage API keys",
+		set: setList(func(c *usersConfig) *[]string { return &c.Auth.Admins })},
+	{name: "rbac.enabled", env: "APP_RBAC_ENABLED", flag: "rbac", usage: "Limit namespaced requests to the roles in rbac.bindings", isBool: true,
+		set: setBool(func(c *usersConfig) *bool { return &c.RBAC.Enabled })},
+	{name: "auth.jwt.jwksFile", env: "APP_JWT_JWKS_FILE", flag: "jwt-jwks", usage: "JWKS file with the keys that sign bearer tokens",
+		set: setString(func(c *usersConfig) *string { return &c.Auth.JWT.JWKSFile })},
+	{name: "auth.jwt.keyFile", env: "APP_JWT_KEY_FILE", flag: "jwt-key", usage: "PEM public key that signs bearer tokens",
+		set: setString(func(c *usersConfig) *string { return &c.Auth.JWT.KeyFile })},
+	{name: "auth.jwt.secret", env: "APP_JWT_SECRET", secret: true,
+		set: setString(func(c *usersConfig) *string { return &c.Auth.JWT.Secret })},
+	{name: "auth.jwt.issuer", env: "APP_JWT_ISSUER", flag: "jwt-issuer", usage: "Required iss of bearer tokens",
+		set: setString(func(c *usersConfig) *string { return &c.Auth.JWT.Issuer })},
+	{name: "auth.jwt.audience", env: "APP_JWT_AUDIENCE", flag: "jwt-audience", usage: "Required aud of bearer tokens",
+		set: setString(func(c *usersConfig) *string { return &c.Auth.JWT.Audience })},
+	{name: "auth.jwt.identityClaim", env: "APP_JWT_IDENTITY_CLAIM", flag: "jwt-identity-claim", usage: "Claim used as the caller identity",
+		set: setString(func(c *usersConfig) *string { return &c.Auth.JWT.IdentityClaim })},
+	{name: "auth.jwt.leeway", env: "APP_JWT_LEEWAY", flag: "jwt-leeway", usage: "Clock skew allowed for exp and nbf, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.Auth.JWT.Leeway })},
+	{name: "log.level", env: "APP_LOG_LEVEL", flag: "log-level", usage: "debug, info, warn, or error",
+		set: setString(func(c *usersConfig) *string { return &c.Log.Level })},
+	{name: "log.file", env: "HTTP_LOG", flag: "log-file", usage: "Log file, empty for stderr",
+		set: setString(func(c *usersConfig) *string { return &c.Log.File })},
+	{name: "trace.exporter", env: "APP_TRACE_EXPORTER", flag: "trace-exporter", usage: "none, otlp, or file",
+		set: setString(func(c *usersConfig) *string { return &c.Trace.Exporter })},
+	{name: "trace.file", env: "APP_TRACE_FILE", flag: "trace-file", usage: "File written by the file trace exporter",
+		set: setString(func(c *usersConfig) *string { return &c.Trace.File })},
+	{name: "trace.sampleRatio", env: "APP_TRACE_SAMPLE_RATIO", flag: "trace-sample-ratio", usage: "Fraction of new traces recorded",
+		set: setFloat(func(c *usersConfig) *float64 { return &c.Trace.SampleRatio })},
+	{name: "limits.rate", env: "APP_RATE_LIMIT", flag: "rate-limit", usage: "Requests a second per client, 0 for no limit",
+		set: setFloat(func(c *usersConfig) *float64 { return &c.Limits.Rate })},
+	{name: "limits.burst", env: "APP_RATE_BURST", flag: "rate-burst", usage: "Requests a client may make at once",
+		set: setInt(func(c *usersConfig) *int { return &c.Limits.Burst })},
+	{name: "limits.maxRecords", env: "APP_QUOTA_MAX_RECORDS", flag: "quota-max-records", usage: "Records per namespace, 0 for no limit",
+		set: setInt(func(c *usersConfig) *int { return &c.Limits.MaxRecords })},
+	{name: "limits.maxDocumentSize", env: "APP_QUOTA_MAX_DOCUMENT_SIZE", flag: "quota-max-document-size", usage: "Bytes per record, 0 for no limit",
+		set: setInt(func(c *usersConfig) *int { return &c.Limits.MaxDocumentSize })},
+	{name: "generator.maxCount", env: "APP_GENERATE_MAX_COUNT", flag: "generate-max-count", usage: "Most records one generate request may create",
+		set: setInt(func(c *usersConfig) *int { return &c.Generator.MaxCount })},
+	{name: "generator.stringLength", env: "APP_GENERATE_STRING_LENGTH", flag: "generate-string-length", usage: "Length of random strings without a maxLength",
+		set: setInt(func(c *usersConfig) *int { return &c.Generator.StringLength })},
+	{name: "generator.timeWindow", env: "APP_GENERATE_TIME_WINDOW", flag: "generate-time-window", usage: "Time window before now used without from, seconds or a duration",
+		set: setDuration(func(c *usersConfig) *time.Duration { return &c.Generator.TimeWindow })},
+}
+
+func setString(field func(c *usersConfig) *string) func(c *usersConfig, v string) error {
+	return func(c *usersConfig, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func setList(field func(c *usersConfig) *[]string) func(c *usersConfig, v string) error {
+	return func(c *usersConfig, v string) error {
+		list := []string{}
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		*field(c) = list
+		return nil
+	}
+}
+
+func setInt(field func(c *usersConfig) *int) func(c *usersConfig, v string) error {
+	return func(c *usersConfig, v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", v)
+		}
+		*field(c) = i
+		return nil
+	}
+}
+
+func setBool(field func(c *usersConfig) *bool) func(c *usersConfig, v string) error {
+	return func(c *usersConfig, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func setFloat(field func(c *usersConfig) *float64) func(c *usersConfig, v string) error {
+	return func(c *usersConfig, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+		*field(c) = f
+		return nil
+	}
+}
+
+// setDuration accepts a whole number of seconds, as the environment
+// variables always have, or a duration such as 1m30s
+func setDuration(field func(c *usersConfig) *time.Duration) func(c *usersConfig, v string) error {
+	return func(c *usersConfig, v string) error {
+		if s, err := strconv.Atoi(v); err == nil {
+			*field(c) = time.Duration(s) * time.Second
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a number of seconds or a duration", v)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// configFlag collects a flag value so only flags given on the command
+// line override other sources
+type configFlag struct {
+	isBool bool
+	value  string
+}
+
+// String implements flag.Value
+func (f *configFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+// Set implements flag.Value
+func (f *configFlag) Set(v string) error {
+	f.value = v
+	return nil
+}
+
+// IsBoolFlag allows -flag as well as -flag=true for bool settings
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// registerConfigFlags adds -config and a flag per setting to fs
+func registerConfigFlags(fs *flag.FlagSet) {
+	fs.Var(&configFlag{}, ConfigFileFlag, "YAML configuration file ("+ConfigFileEnv+")")
+	for _, s := range configSettings {
+		if s.flag != "" {
+			fs.Var(&configFlag{isBool: s.isBool}, s.flag, fmt.Sprintf("%s (%s)", s.usage, s.env))
+		}
+	}
+}
+
+// loadConfig builds the configuration from defaults, the YAML file,
+// the environment, and the flags set in fs, which may be nil, then
+// validates it
+func loadConfig(fs *flag.FlagSet) (usersConfig, error) {
+	c := defaultConfig()
+
+	setFlags := map[string]string{}
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			setFlags[f.Name] = f.Value.String()
+		})
+	}
+
+	if path := configFile(fs); path != "" {
+		if err := c.readFile(path); err != nil {
+			return c, err
+		}
+	}
+
+	var errs []error
+	for _, s := range configSettings {
+		v, err := s.lookupEnv()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if v != "" {
+			if err := s.set(&c, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s (%s): %s", s.env, s.name, err))
+			}
+		}
+	}
+
+	for _, s := range configSettings {
+		if v, ok := setFlags[s.flag]; ok && s.flag != "" {
+			if err := s.set(&c, v); err != nil {
+				errs = append(errs, fmt.Errorf("-%s (%s): %s", s.flag, s.name, err))
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		errs = c.validate()
+	}
+	if len(errs) > 0 {
+		return c, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+
+	return c, nil
+}
+
+// lookupEnv returns the setting's environment variable, for secrets the
+// contents of the file named by the _FILE variable are used instead
+func (s configSetting) lookupEnv() (string, error) {
+	v := os.Getenv(s.env)
+	if !s.secret {
+		return v, nil
+	}
+
+	path := os.Getenv(s.env + "_FILE")
+	if path == "" {
+		return v, nil
+	}
+	if v != "" {
+		return "", fmt.Errorf("%s and %s_FILE: set only one", s.env, s.env)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE (%s): %s", s.env, s.name, err)
+	}
+
+	// Secret files usually end with a newline
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// configFile returns the YAML file named by -config or APP_CONFIG_FILE
+func configFile(fs *flag.FlagSet) string {
+	if fs != nil {
+		if f := fs.Lookup(ConfigFileFlag); f != nil && f.Value.String() != "" {
+			return f.Value.String()
+		}
+	}
+	return os.Getenv(ConfigFileEnv)
+}
+
+// readFile merges the YAML file at path into c, unknown keys are errors
+// so typos are not silently ignored
+func (c *usersConfig) readFile(path string) error {
+	yb, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(yb))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	return nil
+}
+
+// validSSLModes are the sslmode values lib/pq accepts
+var validSSLModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// validate returns every problem found, not just the first
+func (c *usersConfig) validate() []error {
+	var errs []error
+	bad := func(name string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Database.Driver == "" {
+		bad("database.driver", "is required")
+	}
+	if (c.Database.SSLCert == "") != (c.Database.SSLKey == "") {
+		bad("database.sslKey", "database.sslCert and database.sslKey must be set together")
+	}
+
+	for name, n := range map[string]int{
+		"database.pool.maxOpenConns": c.Database.Pool.MaxOpenConns,
+		"database.pool.maxIdleConns": c.Database.Pool.MaxIdleConns,
+		"database.txRetries":         c.Database.TxRetries,
+	} {
+		if n < 0 {
+			bad(name, "%d must not be negative", n)
+		}
+	}
+	for name, d := range map[string]time.Duration{
+		"database.pool.connMaxLifetime": c.Database.Pool.ConnMaxLifetime,
+		"database.pool.connMaxIdleTime": c.Database.Pool.ConnMaxIdleTime,
+		"database.startupTimeout":       c.Database.StartupTimeout,
+	} {
+		if d < 0 {
+			bad(name, "%s must not be negative", d)
+		}
+	}
+
+	if c.Database.Breaker.Failures < 1 {
+		bad("database.breaker.failures", "%d must be at least 1", c.Database.Breaker.Failures)
+	}
+	if c.Database.Breaker.Cooldown <= 0 {
+		bad("database.breaker.cooldown", "%s must be positive", c.Database.Breaker.Cooldown)
+	}
+
+	// A DSN is used as given
+	if c.Database.DSN == "" {
+		if c.Database.Username == "" {
+			bad("database.username", "is required")
+		}
+		if c.Database.Database == "" {
+			bad("database.database", "is required")
+		}
+		if !contains(validSSLModes, c.Database.SSLMode) {
+			bad("database.sslMode", "%q must be one of %s", c.Database.SSLMode, strings.Join(validSSLModes, ", "))
+		}
+		if c.Database.Host == "" {
+			bad("database.host", "is required")
+		}
+		if c.Database.Port < 1 || c.Database.Port > 65535 {
+			bad("database.port", "%d is not between 1 and 65535", c.Database.Port)
+		}
+	}
+
+	if c.HTTP.Port < 1 || c.HTTP.Port > 65535 {
+		bad("http.port", "%d is not between 1 and 65535", c.HTTP.Port)
+	}
+	for name, d := range map[string]time.Duration{
+		"http.readTimeout":     c.HTTP.ReadTimeout,
+		"http.writeTimeout":    c.HTTP.WriteTimeout,
+		"http.shutdownTimeout": c.HTTP.ShutdownTimeout,
+		"http.requestTimeout":  c.HTTP.RequestTimeout,
+		"generator.timeWindow": c.Generator.TimeWindow,
+	} {
+		if d <= 0 {
+			bad(name, "%s must be positive", d)
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		bad("tls.keyFile", "tls.certFile and tls.keyFile must be set together")
+	}
+	switch c.TLS.ClientAuth {
+	case ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if c.TLS.CertFile == "" {
+			bad("tls.clientAuth", "%q needs tls.certFile", c.TLS.ClientAuth)
+		}
+		if c.TLS.ClientCAFile == "" {
+			bad("tls.clientCAFile", "is required when tls.clientAuth is %q", c.TLS.ClientAuth)
+		}
+	default:
+		bad("tls.clientAuth", "%q must be none, optional, or require", c.TLS.ClientAuth)
+	}
+
+	if jc := c.Auth.JWT; jc.enabled() {
+		sources := 0
+		for _, s := range []string{jc.JWKSFile, jc.KeyFile, jc.Secret} {
+			if s != "" {
+				sources++
+			}
+		}
+		if sources > 1 {
+			bad("auth.jwt", "set only one of jwksFile, keyFile, or secret")
+		}
+		if jc.Secret != "" && len(jc.Secret) < minJWTSecretLength {
+			bad("auth.jwt.secret", "must be at least %d bytes", minJWTSecretLength)
+		}
+		if jc.Issuer == "" {
+			bad("auth.jwt.issuer", "is required to accept bearer tokens")
+		}
+		if jc.Audience == "" {
+			bad("auth.jwt.audience", "is required to accept bearer tokens")
+		}
+		if jc.IdentityClaim == "" {
+			bad("auth.jwt.identityClaim", "is required to accept bearer tokens")
+		}
+		if jc.Leeway < 0 {
+			bad("auth.jwt.leeway", "%s must not be negative", jc.Leeway)
+		}
+	}
+
+	errs = append(errs, c.RBAC.validateBindings()...)
+
+	if c.Limits.Rate < 0 {
+		bad("limits.rate", "%g must not be negative", c.Limits.Rate)
+	}
+	if c.Limits.Rate > 0 && c.Limits.Burst < 1 {
+		bad("limits.burst", "%d must be at least 1", c.Limits.Burst)
+	}
+	for name, n := range map[string]int{
+		"limits.maxRecords":      c.Limits.MaxRecords,
+		"limits.maxDocumentSize": c.Limits.MaxDocumentSize,
+	} {
+		if n < 0 {
+			bad(name, "%d must not be negative", n)
+		}
+	}
+
+	if c.Generator.MaxCount < 1 {
+		bad("generator.maxCount", "%d must be at least 1", c.Generator.MaxCount)
+	}
+	if c.Generator.StringLength < 1 {
+		bad("generator.stringLength", "%d must be at least 1", c.Generator.StringLength)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		bad("log.level", "%q must be debug, info, warn, or error", c.Log.Level)
+	}
+
+	switch c.Trace.Exporter {
+	case TraceNone, TraceOTLP:
+	case TraceFile:
+		if c.Trace.File == "" {
+			bad("trace.file", "is required by the file exporter")
+		}
+	default:
+		bad("trace.exporter", "%q must be none, otlp, or file", c.Trace.Exporter)
+	}
+	if c.Trace.SampleRatio < 0 || c.Trace.SampleRatio > 1 {
+		bad("trace.sampleRatio", "%g is not between 0 and 1", c.Trace.SampleRatio)
+	}
+
+	return errs
+}
+
+// contains reports whether list has v
+func contains(list []string, v string) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// connectionString returns the DSN, or builds a key=value connection
+// string from the individual settings
+func (d databaseConfig) connectionString() string {
+	if d.DSN != "" {
+		return d.DSN
+	}
+
+	params := [][2]string{
+		{"user", d.Username},
+		{"password", d.Password},
+		{"dbname", d.Database},
+		{"sslmode", d.SSLMode},
+		{"host", d.Host},
+		{"port", strconv.Itoa(d.Port)},
+		{"sslrootcert", d.SSLRootCert},
+		{"sslcert", d.SSLCert},
+		{"sslkey", d.SSLKey},
+	}
+
+	parts := []string{}
+	for _, p := range params {
+		if p[1] != "" || p[0] == "password" {
+			parts = append(parts, p[0]+"="+quoteDSNValue(p[1]))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteDSNValue quotes values with spaces, quotes, or backslashes as
+// lib/pq expects
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// listenAddr is the host:port the HTTP server listens on
+func (c *usersConfig) listenAddr() string {
+	return net.JoinHostPort(c.HTTP.Host, strconv.Itoa(c.HTTP.Port))
+}
+
+// logLevel parses Log.Level, validate has already checked it
+func (c *usersConfig) logLevel() slog.Level {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(c.Log.Level))
+	return level
+}
+
+// redacted returns a copy safe to print
+func (c usersConfig) redacted() usersConfig {
+	if c.Database.Password != "" {
+		c.Database.Password = redacted
+	}
+	if c.Database.DSN != "" {
+		c.Database.DSN = redactDSN(c.Database.DSN)
+	}
+	if c.Auth.JWT.Secret != "" {
+		c.Auth.JWT.Secret = redacted
+	}
+	return c
+}
+
+// dsnPasswordRE finds the password in a key=value connection string
+var dsnPasswordRE = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// redactDSN hides the password in a URL or key=value connection string
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		q := u.Query()
+		if q.Get("password") != "" {
+			q.Set("password", redacted)
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+	return dsnPasswordRE.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// runConfigCommand implements "config dump", the effective configuration
+// is printed as YAML with secrets redacted
+func runConfigCommand(c usersConfig, args []string, out io.Writer) error {
+	if len(args) != 1 || args[0] != "dump" {
+		return errors.New("usage: config dump")
+	}
+
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.redacted()); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
@@ -0,0 +1,507 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Distributions supported by the generator
+const (
+	DistUniform  string = "uniform"
+	DistNormal   string = "normal"
+	DistWeighted string = "weighted"
+)
+
+// Generation modes
+const (
+	// ModeRandom generates values using the field distributions
+	ModeRandom string = "random"
+	// ModeEdge cycles through boundary and hostile values per column type
+	ModeEdge string = "edge"
+)
+
+// Column types as used in testDataMgr.yaml
+const (
+	ColString string = "string"
+	ColTime   string = "time"
+)
+
+const (
+	// defaultMaxGenerateCount limits the number of records per request
+	defaultMaxGenerateCount int = 1000
+	// maxUniqueAttempts is the number of retries before giving up
+	// on finding a value that has not been used yet
+	maxUniqueAttempts int = 100
+	// default length of random strings, matches the sample data
+	defaultStringLength int = 15
+	// default time window when none is given
+	defaultTimeWindow time.Duration = 30 * 24 * time.Hour
+	// default length of the longest string emitted in edge mode
+	edgeMaxStringLength int = 255
+)
+
+const generatorLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// generatorColumn is a column from the users table definition
+// path is the dotted JSON path in the users document
+type generatorColumn struct {
+	path    string
+	colType string
+}
+
+// usersColumns follows the tables section of testDataMgr.yaml.  Paths
+// use the JSON keys of the users model so generated records have the
+// same shape as created ones, requests may use any case
+var usersColumns = []generatorColumn{
+	{path: "id", colType: ColString},
+	{path: "updated", colType: ColTime},
+	{path: "created", colType: ColTime},
+	{path: "Metadata.id", colType: ColString},
+	{path: "Metadata.Test.key", colType: ColString},
+}
+
+// edgeStrings are boundary and adversarial values for string columns
+// a max length string is added based on the field settings
+var edgeStrings = []interface{}{
+	nil,
+	"",
+	" ",
+	"\t\r\n",
+	"😀👍🏽👨‍👩‍👧‍👦",
+	"Z̤͔ͧ̑̓ä͖̭̈̇lͮ̒ͫǧ̗͚̚o̙̔ͮ̇͐̇",
+	"مرحبا بالعالم",
+	"\u202Egnp.exe",
+	"'; DROP TABLE Acme.users; --",
+	"\" OR 1=1 --",
+	"%_\\",
+	"<script>alert(1)</script>",
+	"null",
+}
+
+// edgeTimes are boundary values for time columns
+var edgeTimes = []interface{}{
+	nil,
+	time.Time{},
+	time.Unix(0, 0).UTC(),
+	time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC),
+	time.Date(2024, 2, 29, 23, 59, 59, 999999000, time.UTC),
+	time.Date(2038, 1, 19, 3, 14, 8, 0, time.UTC),
+	time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+}
+
+// fieldDistribution controls how values for one column are generated
+//
+// swagger:model fieldDistribution
+type fieldDistribution struct {
+	// NullRatio: fraction of records, 0 to 1, where the column is null
+	NullRatio float64 `json:"nullRatio"`
+	// Distribution: uniform, normal, or weighted
+	Distribution string `json:"distribution"`
+	// Values: optional enumeration to pick values from
+	Values []string `json:"values"`
+	// Weights: relative weight of each entry in Values
+	Weights []float64 `json:"weights"`
+	// MinLength: minimum length of random strings
+	MinLength int `json:"minLength"`
+	// MaxLength: maximum length of random strings
+	MaxLength int `json:"maxLength"`
+	// Mean: for strings the mean length, for times the position
+	// in the window between 0 and 1
+	Mean float64 `json:"mean"`
+	// StdDev: standard deviation in the same units as Mean
+	StdDev float64 `json:"stddev"`
+	// Unique: no two records share a value
+	Unique bool `json:"unique"`
+	// From: start of the time window
+	From time.Time `json:"from"`
+	// To: end of the time window
+	To time.Time `json:"to"`
+}
+
+// generateRequest is the body of a generate call
+//
+// swagger:model generateRequest
+type generateRequest struct {
+	// Mode: random or edge, edge ignores Fields except maxLength
+	Mode string `json:"mode"`
+	// Count: number of records to generate, in edge mode it
+	// defaults to enough records to emit every edge value once
+	Count int `json:"count"`
+	// Seed: random seed, 0 picks one based on the time
+	Seed int64 `json:"seed"`
+	// Fields: distribution by column path, i.e. metadata.test.key
+	Fields map[string]fieldDistribution `json:"fields"`
+}
+
+// generator holds the state needed across a single generate request
+type generator struct {
+	mode   string
+	index  int
+	rnd    *rand.Rand
+	fields map[string]fieldDistribution
+	seen   map[string]map[string]bool
+	now    time.Time
+	// defaults from the generator configuration
+	stringLength int
+	timeWindow   time.Duration
+}
+
+// newGenerator validates a request and returns a generator for it
+func newGenerator(req generateRequest) (*generator, error) {
+	switch req.Mode {
+	case "", ModeRandom:
+		req.Mode = ModeRandom
+	case ModeEdge:
+		if req.Count == 0 {
+			req.Count = edgeCaseCount()
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode: %s", req.Mode)
+	}
+
+	// Read once so a reload does not change a request in progress
+	gc := currentConfig().Generator
+
+	if req.Count < 1 || req.Count > gc.MaxCount {
+		return nil, fmt.Errorf("count must be between 1 and %d", gc.MaxCount)
+	}
+
+	g := &generator{
+		mode:         req.Mode,
+		fields:       map[string]fieldDistribution{},
+		seen:         map[string]map[string]bool{},
+		now:          time.Now().UTC(),
+		stringLength: gc.StringLength,
+		timeWindow:   gc.TimeWindow,
+	}
+
+	seed := req.Seed
+	if seed == 0 {
+		seed = g.now.UnixNano()
+	}
+	g.rnd = rand.New(rand.NewSource(seed))
+
+	for path, fd := range req.Fields {
+		col, ok := findColumn(path)
+		if !ok {
+			return nil, fmt.Errorf("unknown field: %s", path)
+		}
+		if err := fd.validate(col, req.Count); err != nil {
+			return nil, fmt.Errorf("field %s: %s", path, err)
+		}
+		g.fields[col.path] = fd
+	}
+
+	return g, nil
+}
+
+// edgeCaseCount is the number of records needed to emit every
+// edge value at least once
+func edgeCaseCount() int {
+	// one extra string for the max length value
+	if len(edgeStrings)+1 > len(edgeTimes) {
+		return len(edgeStrings) + 1
+	}
+	return len(edgeTimes)
+}
+
+// findColumn looks up a column by its path ignoring case
+func findColumn(path string) (generatorColumn, bool) {
+	for _, c := range usersColumns {
+		if strings.EqualFold(c.path, path) {
+			return c, true
+		}
+	}
+	return generatorColumn{}, false
+}
+
+// validate checks a distribution is usable for the column type
+func (fd fieldDistribution) validate(col generatorColumn, count int) error {
+	if fd.NullRatio < 0 || fd.NullRatio > 1 {
+		return errors.New("nullRatio must be between 0 and 1")
+	}
+
+	switch fd.Distribution {
+	case "", DistUniform, DistNormal:
+	case DistWeighted:
+		if len(fd.Values) == 0 {
+			return errors.New("weighted distribution requires values")
+		}
+		if len(fd.Weights) != len(fd.Values) {
+			return errors.New("weights must have one entry per value")
+		}
+		total := 0.0
+		for _, w := range fd.Weights {
+			if w < 0 {
+				return errors.New("weights must not be negative")
+			}
+			total += w
+		}
+		if total == 0 {
+			return errors.New("weights must not all be zero")
+		}
+	default:
+		return fmt.Errorf("unknown distribution: %s", fd.Distribution)
+	}
+
+	if fd.StdDev < 0 {
+		return errors.New("stddev must not be negative")
+	}
+
+	switch col.colType {
+	case ColString:
+		if fd.MinLength < 0 || fd.MaxLength < 0 {
+			return errors.New("lengths must not be negative")
+		}
+		if fd.MaxLength != 0 && fd.MinLength > fd.MaxLength {
+			return errors.New("minLength is greater than maxLength")
+		}
+		if fd.Distribution == DistNormal && len(fd.Values) > 0 {
+			return errors.New("normal distribution does not apply to values")
+		}
+		if fd.Unique && len(fd.Values) > 0 && len(fd.Values) < count {
+			return errors.New("not enough values for unique records")
+		}
+	case ColTime:
+		if len(fd.Values) > 0 {
+			return errors.New("values are not supported for time fields")
+		}
+		if !fd.From.IsZero() && !fd.To.IsZero() && fd.To.Before(fd.From) {
+			return errors.New("to is before from")
+		}
+		if fd.Mean < 0 || fd.Mean > 1 {
+			return errors.New("mean must be between 0 and 1 for time fields")
+		}
+	}
+
+	return nil
+}
+
+// generate returns count documents shaped like the users model
+func (g *generator) generate(count int) ([]map[string]interface{}, error) {
+	docs := make([]map[string]interface{}, 0, count)
+
+	for i := 0; i < count; i++ {
+		doc := map[string]interface{}{}
+		for _, col := range usersColumns {
+			var v interface{}
+			var err error
+
+			if g.mode == ModeEdge {
+				v = g.edgeValue(col)
+			} else {
+				v, err = g.value(col)
+			}
+			if err != nil {
+				return nil, err
+			}
+			setPath(doc, col.path, v)
+		}
+
+		// Edge cases are allowed to be inconsistent
+		if g.mode != ModeEdge {
+			g.orderTimes(doc)
+		}
+		docs = append(docs, doc)
+		g.index++
+	}
+
+	return docs, nil
+}
+
+// value generates one value for a column honouring null ratio
+// and uniqueness
+func (g *generator) value(col generatorColumn) (interface{}, error) {
+	fd := g.fields[col.path]
+
+	if fd.NullRatio > 0 && g.rnd.Float64() < fd.NullRatio {
+		return nil, nil
+	}
+
+	for attempt := 0; attempt < maxUniqueAttempts; attempt++ {
+		var v interface{}
+		var key string
+
+		switch col.colType {
+		case ColTime:
+			t := g.timeValue(fd)
+			v, key = t, t.Format(time.RFC3339Nano)
+		default:
+			s := g.stringValue(fd)
+			v, key = s, s
+		}
+
+		if !fd.Unique {
+			return v, nil
+		}
+
+		if g.seen[col.path] == nil {
+			g.seen[col.path] = map[string]bool{}
+		}
+		if !g.seen[col.path][key] {
+			g.seen[col.path][key] = true
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unable to generate a unique value for %s", col.path)
+}
+
+// edgeValue returns the next boundary value for a column, columns
+// are offset from each other so a record mixes different cases
+func (g *generator) edgeValue(col generatorColumn) interface{} {
+	offset := 0
+	for i, c := range usersColumns {
+		if c.path == col.path {
+			offset = i
+		}
+	}
+
+	switch col.colType {
+	case ColTime:
+		return edgeTimes[(g.index+offset)%len(edgeTimes)]
+	default:
+		max := g.fields[col.path].MaxLength
+		if max == 0 {
+			max = edgeMaxStringLength
+		}
+
+		values := append([]interface{}{strings.Repeat("x", max)}, edgeStrings...)
+		return values[(g.index+offset)%len(values)]
+	}
+}
+
+// stringValue picks from Values or builds a random string
+func (g *generator) stringValue(fd fieldDistribution) string {
+	if len(fd.Values) > 0 {
+		if fd.Distribution == DistWeighted {
+			return fd.Values[g.weightedIndex(fd.Weights)]
+		}
+		return fd.Values[g.rnd.Intn(len(fd.Values))]
+	}
+
+	// Without any lengths use the fixed default length
+	min, max := fd.MinLength, fd.MaxLength
+	if max == 0 {
+		max = g.stringLength
+		if min > max {
+			max = min
+		}
+		if min == 0 {
+			min = max
+		}
+	}
+
+	length := min
+	switch fd.Distribution {
+	case DistNormal:
+		mean := fd.Mean
+		if mean == 0 {
+			mean = float64(min+max) / 2
+		}
+		length = int(math.Round(g.rnd.NormFloat64()*fd.StdDev + mean))
+		if length < min {
+			length = min
+		}
+		if length > max {
+			length = max
+		}
+	default:
+		if max > min {
+			length = min + g.rnd.Intn(max-min+1)
+		}
+	}
+
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = generatorLetters[g.rnd.Intn(len(generatorLetters))]
+	}
+	return string(b)
+}
+
+// timeValue returns a time inside the configured window
+func (g *generator) timeValue(fd fieldDistribution) time.Time {
+	from, to := fd.From, fd.To
+	if to.IsZero() {
+		to = g.now
+	}
+	if from.IsZero() {
+		from = to.Add(-g.timeWindow)
+	}
+
+	span := to.Sub(from)
+	if span <= 0 {
+		return from.UTC()
+	}
+
+	var pos float64
+	switch fd.Distribution {
+	case DistNormal:
+		mean, sd := fd.Mean, fd.StdDev
+		if mean == 0 {
+			mean = 0.5
+		}
+		if sd == 0 {
+			sd = 0.15
+		}
+		pos = math.Min(math.Max(g.rnd.NormFloat64()*sd+mean, 0), 1)
+	default:
+		pos = g.rnd.Float64()
+	}
+
+	return from.Add(time.Duration(pos * float64(span))).UTC().Truncate(time.Second)
+}
+
+// weightedIndex returns an index with probability proportional
+// to its weight
+func (g *generator) weightedIndex(weights []float64) int {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	r := g.rnd.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(weights) - 1
+}
+
+// orderTimes makes sure a record is not updated before it was created
+func (g *generator) orderTimes(doc map[string]interface{}) {
+	c, cok := doc["created"].(time.Time)
+	u, uok := doc["updated"].(time.Time)
+	if cok && uok && u.Before(c) {
+		doc["updated"] = c
+	}
+}
+
+// setPath sets a value in a nested document using a dotted path
+func setPath(doc map[string]interface{}, path string, v interface{}) {
+	parts := strings.Split(path, ".")
+	m := doc
+	for _, p := range parts[:len(parts)-1] {
+		child, ok := m[p].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			m[p] = child
+		}
+		m = child
+	}
+	m[parts[len(parts)-1]] = v
+}
@@ -0,0 +1,169 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Health check status values
+const (
+	HealthOK   string = "ok"
+	HealthFail string = "fail"
+)
+
+// healthCheckTimeout bounds each individual check
+const healthCheckTimeout = 2 * time.Second
+
+// healthCheck is the result of one check
+//
+// swagger:model healthCheck
+type healthCheck struct {
+	// Status: ok or fail
+	Status string `json:"status"`
+	// Duration: time taken by the check
+	Duration string `json:"duration"`
+	// Error: why the check failed
+	Error string `json:"error,omitempty"`
+}
+
+// healthResponse is the body of /healthz, /readyz and /livez
+//
+// swagger:response healthResponse
+type healthResponse struct {
+	// Status: ok when every check passed
+	Status string `json:"status"`
+	// Checks: results by check name
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// healthFunc returns nil when healthy
+type healthFunc func(ctx context.Context) error
+
+// initializeHealthRoutes adds the probe endpoints, they are not
+// namespaced or versioned so probes stay stable
+func (a *UsersApp) initializeHealthRoutes() {
+	a.Router.HandleFunc("/livez", a.healthHandler(map[string]healthFunc{
+		"workers": a.checkWorkers,
+	})).Methods("GET")
+
+	a.Router.HandleFunc("/readyz", a.healthHandler(map[string]healthFunc{
+		"database":   a.checkDatabase,
+		"migrations": a.checkMigrations,
+	})).Methods("GET")
+
+	a.Router.HandleFunc("/healthz", a.healthHandler(map[string]healthFunc{
+		"database":   a.checkDatabase,
+		"migrations": a.checkMigrations,
+		"workers":    a.checkWorkers,
+	})).Methods("GET")
+}
+
+// healthHandler runs checks and answers 200 when all pass, 503 otherwise
+func (a *UsersApp) healthHandler(checks map[string]healthFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := healthResponse{Status: HealthOK, Checks: map[string]healthCheck{}}
+
+		for name, check := range checks {
+			ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+			start := time.Now()
+			err := check(ctx)
+			cancel()
+
+			hc := healthCheck{Status: HealthOK, Duration: time.Since(start).String()}
+			if err != nil {
+				hc.Status = HealthFail
+				hc.Error = err.Error()
+				resp.Status = HealthFail
+			}
+			resp.Checks[name] = hc
+		}
+
+		code := http.StatusOK
+		if resp.Status != HealthOK {
+			code = http.StatusServiceUnavailable
+		}
+		respondWithJSON(w, code, resp)
+	}
+}
+
+// checkDatabase pings the database
+func (a *UsersApp) checkDatabase(ctx context.Context) error {
+	if a.DB == nil {
+		return errors.New("database not initialized")
+	}
+	return a.DB.PingContext(ctx)
+}
+
+// checkMigrations verifies every embedded migration was applied
+func (a *UsersApp) checkMigrations(ctx context.Context) error {
+	if a.DB == nil {
+		return errors.New("database not initialized")
+	}
+
+	ml, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	rows, err := a.DB.QueryContext(ctx, `SELECT version FROM Acme.usersMigrations;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return err
+		}
+		applied[v] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	pending := []string{}
+	for _, m := range ml {
+		if !applied[m.version] {
+			pending = append(pending, fmt.Sprintf("%04d_%s", m.version, m.name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("pending migrations: %s", strings.Join(pending, ", "))
+	}
+
+	return nil
+}
+
+// checkWorkers fails if a background worker stopped before shutdown
+func (a *UsersApp) checkWorkers(ctx context.Context) error {
+	a.workersMu.Lock()
+	defer a.workersMu.Unlock()
+
+	stopped := []string{}
+	for name, running := range a.workerStatus {
+		if !running {
+			stopped = append(stopped, name)
+		}
+	}
+	if len(stopped) > 0 && !a.shuttingDown {
+		sort.Strings(stopped)
+		return fmt.Errorf("stopped workers: %s", strings.Join(stopped, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+)
+
+// Authentication methods recorded in an identity
+const (
+	// AuthMTLS caller presented a verified client certificate
+	AuthMTLS string = "mtls"
+	// AuthJWT caller presented a valid bearer token
+	AuthJWT string = "jwt"
+	// AuthAPIKey caller presented an API key
+	AuthAPIKey string = "apikey"
+)
+
+// identity is the authenticated caller of a request
+//
+// swagger:model identity
+type identity struct {
+	// Name: used for authorization and audit
+	Name string `json:"name"`
+	// Method: how the caller was authenticated, i.e. mtls, jwt, or apikey
+	Method string `json:"method"`
+
+	// key limits what callers using an API key can do
+	key *apiKey
+}
+
+// identityKey stores the identity in a request context
+type identityKey struct{}
+
+// withIdentity returns a context carrying id
+func withIdentity(ctx context.Context, id identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the caller of the request ctx belongs to
+func identityFrom(ctx context.Context) (identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(identity)
+	return id, ok
+}
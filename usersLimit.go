@@ -0,0 +1,181 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bucketIdleTimeout is how long an unused bucket is kept, a full
+// bucket and a missing one behave the same
+const bucketIdleTimeout = 10 * time.Minute
+
+// limitRejections counts requests refused by a limit or quota
+var limitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "users_limit_rejections_total",
+	Help: "Requests refused by limit: rate, records, or documentSize.",
+}, []string{"limit"})
+
+// tokenBucket holds the tokens left for one client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client.  Buckets refill at
+// limits.rate tokens a second up to limits.burst, each request takes one
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// take removes a token from the bucket of client, when it is empty the
+// time until a token is available is returned
+func (l *rateLimiter) take(client string, rate float64, burst int, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	if now.Sub(l.lastSweep) > bucketIdleTimeout {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// refund gives back a token taken from the bucket of client
+func (l *rateLimiter) refund(client string, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[client]; ok {
+		b.tokens = math.Min(float64(burst), b.tokens+1)
+	}
+}
+
+// rateLimitKey stores the address bucket a request was charged to
+type rateLimitKey struct{}
+
+// rateLimitMiddleware answers 429 to clients that exceed limits.rate on
+// the API routes.  It runs before credentials are checked and charges
+// the bucket of the client address, so failed credentials are limited
+// without a database lookup
+func (a *UsersApp) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lc := currentConfig().Limits
+		if lc.Rate <= 0 || !strings.HasPrefix(r.URL.Path, UsersAPIVersion+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client, _ := r.Context().Value(clientKey{}).(auditClient)
+		bucket := "ip:" + client.Address
+		if wait, ok := a.limiter.take(bucket, lc.Rate, lc.Burst, time.Now()); !ok {
+			respondRateLimited(w, r, bucket, wait)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), rateLimitKey{}, bucket)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// identityRateLimitMiddleware runs after authentication and moves the
+// charge of authenticated callers from their address to their identity,
+// so callers behind one proxy do not share a bucket and one identity
+// does not get a bucket per address
+func (a *UsersApp) identityRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, charged := r.Context().Value(rateLimitKey{}).(string)
+		id, ok := identityFrom(r.Context())
+		if !charged || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		lc := currentConfig().Limits
+		a.limiter.refund(bucket, lc.Burst)
+		bucket = "identity:" + id.Name
+		if wait, ok := a.limiter.take(bucket, lc.Rate, lc.Burst, time.Now()); !ok {
+			respondRateLimited(w, r, bucket, wait)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// respondRateLimited answers 429 and tells the caller when to retry
+func respondRateLimited(w http.ResponseWriter, r *http.Request, bucket string, wait time.Duration) {
+	limitRejections.WithLabelValues("rate").Inc()
+	slog.WarnContext(r.Context(), "Rate limited", "client", bucket)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, "rate limit exceeded")
+}
+
+// checkDocumentSize refuses documents over limits.maxDocumentSize
+func checkDocumentSize(jb []byte) error {
+	max := currentConfig().Limits.MaxDocumentSize
+	if max > 0 && len(jb) > max {
+		limitRejections.WithLabelValues("documentSize").Inc()
+		return errQuota("document of %d bytes exceeds the quota of %d bytes", len(jb), max)
+	}
+	return nil
+}
+
+// checkRecordQuota refuses adding records to a namespace that would then
+// hold more than limits.maxRecords.  It counts inside tx so concurrent
+// inserts conflict instead of both passing
+func checkRecordQuota(ctx context.Context, tx *sql.Tx, namespace string, adding int) error {
+	max := currentConfig().Limits.MaxRecords
+	if max <= 0 || adding <= 0 {
+		return nil
+	}
+
+	var existing int
+	count := `SELECT count(*) FROM Acme.users WHERE namespace = $1;`
+	if err := tx.QueryRowContext(ctx, count, namespace).Scan(&existing); err != nil {
+		return err
+	}
+	if existing+adding > max {
+		limitRejections.WithLabelValues("records").Inc()
+		return errQuota("namespace %s holds %d of %d records, %d more do not fit", namespace, existing, max, adding)
+	}
+	return nil
+}
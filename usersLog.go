@@ -0,0 +1,143 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the request ID, one is assigned when the
+// caller does not send it
+const RequestIDHeader string = "X-Request-ID"
+
+// maxRequestIDLength limits IDs accepted from callers
+const maxRequestIDLength = 128
+
+// logLevel is shared by every logger so it can change at run time
+var logLevel = new(slog.LevelVar)
+
+// requestIDKey stores the request ID in a request context
+type requestIDKey struct{}
+
+// initializeLogging sends JSON log records to w.  The standard log
+// package is redirected too so log.Printf lines are logged at info
+func initializeLogging(w io.Writer) {
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{AddSource: true, Level: logLevel})
+	slog.SetDefault(slog.New(contextHandler{h}))
+}
+
+// contextHandler adds the request, trace, and span IDs found in the
+// context to each record
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle implements slog.Handler
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if id, ok := identityFrom(ctx); ok {
+		r.AddAttrs(slog.String("identity", id.Name))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+		if sc.HasSpanID() {
+			r.AddAttrs(slog.String("span_id", sc.SpanID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestID returns the ID of the request ctx belongs to, if any
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID accepts printable ASCII so IDs are safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware propagates the caller's X-Request-ID or assigns a
+// new one, and returns it in the response
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// logRequest writes an access log record per request, server errors
+// are logged at error and client errors at warn.  Requests whose
+// handler panicked are logged too
+func logRequest(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+
+		panicked := true
+		defer func() {
+			status := sr.responseStatus(panicked)
+			level := slog.LevelInfo
+			switch {
+			case status >= http.StatusInternalServerError:
+				level = slog.LevelError
+			case status >= http.StatusBadRequest:
+				level = slog.LevelWarn
+			}
+
+			slog.LogAttrs(r.Context(), level, "access",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("route", routeTemplate(r)),
+				slog.Int("status", status),
+				slog.Int("bytes", sr.bytes),
+				slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.String("remote", r.RemoteAddr),
+				slog.String("user_agent", r.UserAgent()),
+			)
+		}()
+
+		handler.ServeHTTP(sr, r)
+		panicked = false
+	})
+}
@@ -9,12 +9,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
-	"log"
+	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"log/slog"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,6 +35,10 @@ const (
 	UsersResourceType string = "users"
 	// The email or account login used by 3rd parth provider
 	UsersKey string = "/{key}"
+	// UsersSnapshots named copies of a namespace
+	UsersSnapshots string = "snapshots"
+	// UsersClone copies a namespace into a new one
+	UsersClone string = "clone"
 )
 
 // Options for looking up a user
@@ -42,40 +51,184 @@ const (
 type UsersApp struct {
 	Router *mux.Router
 	DB     *sql.DB
+
+	// flags given on the command line, read again on reload
+	flags *flag.FlagSet
+
+	// metrics served on MetricsPath
+	metrics *prometheus.Registry
+
+	// tracer provider and the file used by the file exporter
+	tracing   *sdktrace.TracerProvider
+	traceFile *os.File
+
+	// background workers stopped on shutdown
+	workers       sync.WaitGroup
+	workersOnce   sync.Once
+	workersCtx    context.Context
+	workersCancel context.CancelFunc
+
+	// verifies bearer tokens, nil when they are not accepted
+	jwt atomic.Pointer[jwtVerifier]
+
+	// store circuit breaker, open while the database is unavailable
+	breaker storeBreaker
+
+	// token buckets of API clients
+	limiter rateLimiter
+
+	// running state by worker name, reported by health checks
+	workersMu    sync.Mutex
+	workerStatus map[string]bool
+	shuttingDown bool
 }
 
-// both db and http configuration can be changed using environment varialbes
+// both db and http configuration can be changed using a config file,
+// environment variables, or flags, see loadConfig
 type databaseConfig struct {
-	username string
-	password string
-	database string
-	sslMode  string
-	dbDriver string
-	ip       string
-	port     string
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Database string `yaml:"database"`
+	SSLMode  string `yaml:"sslMode"`
+	Driver   string `yaml:"driver"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	// client certificates for secure clusters
+	SSLRootCert string `yaml:"sslRootCert"`
+	SSLCert     string `yaml:"sslCert"`
+	SSLKey      string `yaml:"sslKey"`
+	// DSN replaces every connection setting above when set
+	DSN string `yaml:"dsn"`
+	// apply pending migrations on startup
+	AutoMigrate bool `yaml:"autoMigrate"`
+	// Pool limits apply on reload
+	Pool poolConfig `yaml:"pool"`
+	// TxRetries is how often a write is retried after a serialization failure
+	TxRetries int `yaml:"txRetries"`
+	// StartupTimeout is how long startup waits for the database
+	StartupTimeout time.Duration `yaml:"startupTimeout"`
+	// Breaker settings apply on reload
+	Breaker breakerConfig `yaml:"breaker"`
+}
+
+// Store circuit breaker settings
+type breakerConfig struct {
+	// Failures in a row that open the breaker
+	Failures int `yaml:"failures"`
+	// Cooldown before a request is let through to test the store
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// Database connection pool limits, zero means unlimited
+type poolConfig struct {
+	MaxOpenConns    int           `yaml:"maxOpenConns"`
+	MaxIdleConns    int           `yaml:"maxIdleConns"`
+	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"connMaxIdleTime"`
 }
 
 // HTTP server configuration
 type httpConfig struct {
-	ip              string
-	port            string
-	shutdownTimeout time.Duration
-	readTimeout     time.Duration
-	writeTimeout    time.Duration
-	listenString    string
-	logPath         string
+	Host            string        `yaml:"host"`
+	Port            int           `yaml:"port"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	ReadTimeout     time.Duration `yaml:"readTimeout"`
+	WriteTimeout    time.Duration `yaml:"writeTimeout"`
+	// RequestTimeout bounds handlers and the queries they run
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
 }
 
-// Global for use in the module
+// TLS configuration, without a certificate the server uses plain HTTP
+type tlsConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCAFile verifies client certificates
+	ClientCAFile string `yaml:"clientCAFile"`
+	// none, optional, or require
+	ClientAuth string `yaml:"clientAuth"`
+	// Identities maps client certificate subjects to identity names
+	Identities map[string]string `yaml:"identities"`
+}
 
-// Set default database configuration
-var dbconf = databaseConfig{username: "root", password: "", database: "pavedroad", sslMode: "disable", dbDriver: "postgres", ip: "127.0.0.1", port: "26257"}
+// Authentication configuration
+type authConfig struct {
+	// Anonymous allows API requests without credentials
+	Anonymous bool      `yaml:"anonymous"`
+	JWT       jwtConfig `yaml:"jwt"`
+	// Admins are the identities allowed to manage API keys
+	Admins []string `yaml:"admins"`
+}
 
-// Set default http configuration
-var httpconf = httpConfig{ip: "127.0.0.1", port: "8082", shutdownTimeout: 15, readTimeout: 60, writeTimeout: 60, listenString: "127.0.0.1:8082", logPath: "logs/users.log"}
+// Role-based access control, identities in auth.admins are not limited
+type rbacConfig struct {
+	// Enabled refuses namespaced requests no binding allows
+	Enabled  bool          `yaml:"enabled"`
+	Bindings []roleBinding `yaml:"bindings"`
+}
+
+// roleBinding grants a role to an identity in some namespaces
+type roleBinding struct {
+	// Identity is a name from a certificate, token, or anonymous
+	Identity string `yaml:"identity"`
+	// viewer, editor, or admin
+	Role string `yaml:"role"`
+	// Namespaces the role applies to, * is every namespace
+	Namespaces []string `yaml:"namespaces"`
+}
 
-// shutdownTimeout will be initialized based on the default or HTTP_SHUTDOWN_TIMEOUT
-var shutdowTimeout time.Duration
+// JWT bearer token validation, set one of JWKSFile, KeyFile, or Secret
+type jwtConfig struct {
+	// JWKSFile holds RSA, EC, or oct keys selected by kid
+	JWKSFile string `yaml:"jwksFile"`
+	// KeyFile is a PEM public key or certificate
+	KeyFile string `yaml:"keyFile"`
+	// Secret is the HS256 shared key
+	Secret   string `yaml:"secret"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// IdentityClaim names the claim used as the identity
+	IdentityClaim string `yaml:"identityClaim"`
+	// Leeway allowed for clock skew when checking exp and nbf
+	Leeway time.Duration `yaml:"leeway"`
+}
+
+// Logging configuration
+type logConfig struct {
+	// debug, info, warn, or error
+	Level string `yaml:"level"`
+	// empty logs to stderr
+	File string `yaml:"file"`
+}
+
+// Request rate limits and storage quotas, zero disables a limit
+type limitsConfig struct {
+	// Rate is the requests a second each client may make on average
+	Rate float64 `yaml:"rate"`
+	// Burst is the requests a client may make at once
+	Burst int `yaml:"burst"`
+	// MaxRecords a namespace may hold
+	MaxRecords int `yaml:"maxRecords"`
+	// MaxDocumentSize of a stored record in bytes
+	MaxDocumentSize int `yaml:"maxDocumentSize"`
+}
+
+// Generator limits and defaults
+type generatorConfig struct {
+	MaxCount     int           `yaml:"maxCount"`
+	StringLength int           `yaml:"stringLength"`
+	TimeWindow   time.Duration `yaml:"timeWindow"`
+}
+
+// Tracing configuration
+type traceConfig struct {
+	// none, otlp, or file
+	Exporter string `yaml:"exporter"`
+	File     string `yaml:"file"`
+	// fraction of new traces sampled, callers' decisions are kept
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// Global for use in the module
 
 // GitTag is used for namespace functionality
 var GitTag string
@@ -97,18 +250,54 @@ func printVersion() {
 func main() {
 
 	versionFlag := flag.Bool("v", false, "Print version information")
+	inferFlag := flag.String("infer", "", "Print the schema inferred from an NDJSON file, - for stdin")
+	registerConfigFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *versionFlag {
 		printVersion()
 	}
 
+	if *inferFlag != "" {
+		if err := inferSchemaFile(*inferFlag, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	c, err := loadConfig(flag.CommandLine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	setConfig(c)
+
+	// config dump
+	if flag.Arg(0) == "config" {
+		if err := runConfigCommand(c, flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// migrate up | down [steps] | status
+	if flag.Arg(0) == "migrate" {
+		a := UsersApp{}
+		a.initializeDB()
+		if err := runMigrateCommand(a.DB, flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Setup loggin
-	openLogFile(httpconf.logPath)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	log.Printf("Logfile opened %s", httpconf.logPath)
+	initializeLogging(openLogFile(c.Log.File))
+	slog.Info("Logfile opened", "path", c.Log.File)
 
-	a := UsersApp{}
+	a := UsersApp{flags: flag.CommandLine}
 	a.Initialize()
-	a.Run(httpconf.listenString)
+	os.Exit(a.Run(c.listenAddr()))
 }
@@ -0,0 +1,223 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Masking policies applied to a column on export or clone
+const (
+	// MaskRedact replaces strings with MaskRedacted and other values with null
+	MaskRedact string = "redact"
+	// MaskHash replaces a value with its HMAC-SHA256 under the mask key,
+	// unkeyed hashes of guessable values are easy to reverse
+	MaskHash string = "hash"
+	// MaskTokenize replaces a value with a keyed token, equal values
+	// get equal tokens
+	MaskTokenize string = "tokenize"
+	// MaskShuffle permutes the column values between records
+	MaskShuffle string = "shuffle"
+	// MaskFake replaces letters and digits keeping case, length and
+	// punctuation, times are moved by up to a year
+	MaskFake string = "fake"
+)
+
+// usersExport is NDJSON, one users document per line
+//
+// swagger:response usersExport
+type usersExport struct {
+	// in: body
+	Body string
+}
+
+// MaskRedacted is the value used for redacted strings
+const MaskRedacted string = "[REDACTED]"
+
+// defaultMaskKey is used when a request does not provide a maskKey,
+// tokens are then only consistent for the life of the process
+var defaultMaskKey = func() []byte {
+	k := make([]byte, 32)
+	if _, err := crand.Read(k); err != nil {
+		panic(err)
+	}
+	return k
+}()
+
+// masker applies masking policies to users documents
+type masker struct {
+	policies map[string]string
+	key      []byte
+	rnd      *rand.Rand
+}
+
+// newMasker validates policies, keyed by dotted column path.  Paths
+// must name a column of usersColumns
+func newMasker(masks map[string]string, key string) (*masker, error) {
+	m := &masker{policies: map[string]string{}, key: defaultMaskKey}
+	if key != "" {
+		m.key = []byte(key)
+	}
+
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+	m.rnd = rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+
+	for path, policy := range masks {
+		if _, ok := findColumn(path); !ok {
+			return nil, fmt.Errorf("unknown mask column: %s", path)
+		}
+		switch policy {
+		case MaskRedact, MaskHash, MaskTokenize, MaskShuffle, MaskFake:
+			m.policies[path] = policy
+		default:
+			return nil, fmt.Errorf("unknown mask policy %s for %s", policy, path)
+		}
+	}
+
+	return m, nil
+}
+
+// apply masks every document in place, shuffle needs the whole set
+func (m *masker) apply(docs []interface{}) {
+	for path, policy := range m.policies {
+		parts := strings.Split(path, ".")
+
+		if policy == MaskShuffle {
+			values := []interface{}{}
+			for _, d := range docs {
+				visitPath(d, parts, func(v interface{}) interface{} {
+					values = append(values, v)
+					return v
+				})
+			}
+
+			m.rnd.Shuffle(len(values), func(i, j int) {
+				values[i], values[j] = values[j], values[i]
+			})
+
+			next := 0
+			for _, d := range docs {
+				visitPath(d, parts, func(v interface{}) interface{} {
+					v = values[next]
+					next++
+					return v
+				})
+			}
+			continue
+		}
+
+		for _, d := range docs {
+			visitPath(d, parts, func(v interface{}) interface{} {
+				return m.mask(policy, v)
+			})
+		}
+	}
+}
+
+// mask applies a single value policy, nulls are left alone
+func (m *masker) mask(policy string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	switch policy {
+	case MaskRedact:
+		if _, ok := v.(string); ok {
+			return MaskRedacted
+		}
+		return nil
+	case MaskHash:
+		return hex.EncodeToString(m.mac(v))
+	case MaskTokenize:
+		mac := m.mac(v)
+		return "tok_" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(mac[:10]))
+	case MaskFake:
+		return m.fake(v)
+	}
+
+	return v
+}
+
+// mac returns the keyed hash of a value
+func (m *masker) mac(v interface{}) []byte {
+	h := hmac.New(sha256.New, m.key)
+	_, _ = h.Write([]byte(fmt.Sprint(v)))
+	return h.Sum(nil)
+}
+
+// fake returns a value with the same format, seeded by the value
+// so equal inputs give equal outputs
+func (m *masker) fake(v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		// Numbers and booleans keep their type but not their value
+		switch v.(type) {
+		case float64:
+			return float64(binary.LittleEndian.Uint16(m.mac(v)))
+		case bool:
+			return m.mac(v)[0]&1 == 1
+		}
+		return nil
+	}
+
+	r := rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(m.mac(s)))))
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		shift := time.Duration(r.Int63n(int64(2*365*24*time.Hour))) - 365*24*time.Hour
+		return t.Add(shift).Truncate(time.Second).Format(time.RFC3339)
+	}
+
+	out := []rune(s)
+	for i, c := range out {
+		switch {
+		case unicode.IsDigit(c):
+			out[i] = rune('0' + r.Intn(10))
+		case unicode.IsUpper(c):
+			out[i] = rune('A' + r.Intn(26))
+		case unicode.IsLetter(c):
+			out[i] = rune('a' + r.Intn(26))
+		}
+	}
+	return string(out)
+}
+
+// visitPath calls fn for each value found at path and stores its result,
+// keys match ignoring case and arrays are visited element by element
+func visitPath(v interface{}, parts []string, fn func(interface{}) interface{}) {
+	switch val := v.(type) {
+	case []interface{}:
+		for _, e := range val {
+			visitPath(e, parts, fn)
+		}
+	case map[string]interface{}:
+		for k, e := range val {
+			if !strings.EqualFold(k, parts[0]) {
+				continue
+			}
+			if len(parts) == 1 {
+				val[k] = fn(e)
+				continue
+			}
+			visitPath(e, parts[1:], fn)
+		}
+	}
+}
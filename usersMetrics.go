@@ -0,0 +1,202 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is scraped by Prometheus
+const MetricsPath string = "/metrics"
+
+// namespaceCountTimeout bounds the record count query run per scrape
+const namespaceCountTimeout = 2 * time.Second
+
+// Request and database metrics are shared by every UsersApp, each
+// app registers them in its own registry
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "users_http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "users_db_query_duration_seconds",
+		Help:    "Database time by model operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	namespaceRecordsDesc = prometheus.NewDesc(
+		"users_namespace_records",
+		"Number of users records per namespace.",
+		[]string{"namespace"}, nil)
+)
+
+// observeDB times a model operation and traces it as a child of the
+// request span, use as defer observeDB(ctx, "getUsers")()
+func observeDB(ctx context.Context, operation string) func() {
+	start := time.Now()
+	span := startStoreSpan(ctx, operation)
+	return func() {
+		dbDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		span.End()
+	}
+}
+
+// initializeMetrics creates the registry served on MetricsPath
+func (a *UsersApp) initializeMetrics() {
+	a.metrics = prometheus.NewRegistry()
+	a.metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		dbDuration,
+		txRetries,
+		breakerOpen,
+		limitRejections,
+		namespaceCollector{db: a.DB},
+	)
+
+	if a.DB != nil {
+		a.metrics.MustRegister(collectors.NewDBStatsCollector(a.DB, currentConfig().Database.Database))
+	}
+}
+
+// initializeMetricsRoutes adds MetricsPath, initializeRoutes registers
+// metricsMiddleware outside the others so their refusals are counted
+func (a *UsersApp) initializeMetricsRoutes() {
+	if a.metrics == nil {
+		a.initializeMetrics()
+	}
+
+	a.Router.Handle(MetricsPath, promhttp.HandlerFor(a.metrics, promhttp.HandlerOpts{})).Methods("GET")
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+// WriteHeader records the status code
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Write defaults the status to 200 like http.ResponseWriter
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// responseStatus is the status the handler answered with.  Handlers
+// that wrote nothing answered 200, unless they panicked and
+// recoverMiddleware is about to answer 500
+func (sr *statusRecorder) responseStatus(panicked bool) int {
+	switch {
+	case sr.status != 0:
+		return sr.status
+	case panicked:
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// metricsMiddleware counts and times requests by route template so
+// namespaces and keys do not become labels
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+
+		panicked := true
+		defer func() {
+			route := routeTemplate(r)
+			code := strconv.Itoa(sr.responseStatus(panicked))
+			httpRequests.WithLabelValues(route, r.Method, code).Inc()
+			httpDuration.WithLabelValues(route, r.Method, code).Observe(time.Since(start).Seconds())
+		}()
+
+		next.ServeHTTP(sr, r)
+		panicked = false
+	})
+}
+
+// routeTemplate returns the matched route, i.e.
+// /api/v1/namespace/{namespace}/users/{key}
+func routeTemplate(r *http.Request) string {
+	if cr := mux.CurrentRoute(r); cr != nil {
+		if tmpl, err := cr.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
+
+// namespaceCollector reports record counts per namespace at scrape time
+type namespaceCollector struct {
+	db *sql.DB
+}
+
+// Describe implements prometheus.Collector
+func (nc namespaceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- namespaceRecordsDesc
+}
+
+// Collect implements prometheus.Collector
+func (nc namespaceCollector) Collect(ch chan<- prometheus.Metric) {
+	if nc.db == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), namespaceCountTimeout)
+	defer cancel()
+
+	statement := `SELECT namespace, count(*) FROM Acme.users GROUP BY namespace;`
+	rows, err := nc.db.QueryContext(ctx, statement)
+	if err != nil {
+		slog.Error("Namespace record count failed", "error", err)
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var ns string
+		var count float64
+		if err := rows.Scan(&ns, &count); err != nil {
+			slog.Error("SQL rows.Scan failed", "error", err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(namespaceRecordsDesc, prometheus.GaugeValue, count, ns)
+	}
+}
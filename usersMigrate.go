@@ -0,0 +1,307 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles are named NNNN_description.up.sql and NNNN_description.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsBootstrap creates the database and the table that tracks
+// applied versions
+const migrationsBootstrap = `
+CREATE DATABASE IF NOT EXISTS Acme;
+
+CREATE TABLE IF NOT EXISTS Acme.usersMigrations (
+    version INT PRIMARY KEY,
+    name STRING NOT NULL,
+    applied TIMESTAMPTZ NOT NULL DEFAULT now()
+);`
+
+// noTransaction starts migrations that can not run in a transaction,
+// such as a primary key change which CockroachDB runs as a schema job.
+// They should hold a single statement, several are still run as one
+// implicit transaction, and be safe to repeat as they are recorded
+// after they ran
+const noTransaction = "-- migrate:no-transaction"
+
+// migration is one numbered schema change
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrationState reports whether a migration was applied
+type migrationState struct {
+	Version int        `json:"version"`
+	Name    string     `json:"name"`
+	Applied *time.Time `json:"applied"`
+}
+
+// loadMigrations returns the embedded migrations ordered by version
+func loadMigrations() ([]migration, error) {
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, f := range files {
+		name := f.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s must end in .up.sql or .down.sql", name)
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s must start with a version number", name)
+		}
+
+		body, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: parts[1]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	ml := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both up and down files", m.version, m.name)
+		}
+		ml = append(ml, *m)
+	}
+	sort.Slice(ml, func(i, j int) bool { return ml[i].version < ml[j].version })
+
+	return ml, nil
+}
+
+// appliedMigrations returns the applied versions and when
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	if _, err := db.Exec(migrationsBootstrap); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT version, applied FROM Acme.usersMigrations;`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var v int
+		var t time.Time
+		if err := rows.Scan(&v, &t); err != nil {
+			return nil, err
+		}
+		applied[v] = t
+	}
+
+	return applied, rows.Err()
+}
+
+// migrateUp applies every pending migration in order and returns
+// the number applied
+func migrateUp(db *sql.DB) (int, error) {
+	ml, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range ml {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+
+		record := `INSERT INTO Acme.usersMigrations(version, name) VALUES ($1, $2);`
+		if err := runMigration(db, m.up, record, m.version, m.name); err != nil {
+			// Another instance may have applied it at the same time
+			if again, e := appliedMigrations(db); e == nil {
+				if _, ok := again[m.version]; ok {
+					continue
+				}
+			}
+			return count, fmt.Errorf("migration %04d_%s failed: %s", m.version, m.name, err)
+		}
+
+		slog.Info("Applied migration", "version", m.version, "name", m.name)
+		count++
+	}
+
+	return count, nil
+}
+
+// migrateDown reverts the latest steps applied migrations
+func migrateDown(db *sql.DB, steps int) (int, error) {
+	ml, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(ml) - 1; i >= 0 && count < steps; i-- {
+		m := ml[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+
+		record := `DELETE FROM Acme.usersMigrations WHERE version = $1 AND name = $2;`
+		if err := runMigration(db, m.down, record, m.version, m.name); err != nil {
+			return count, fmt.Errorf("migration %04d_%s failed: %s", m.version, m.name, err)
+		}
+
+		slog.Info("Reverted migration", "version", m.version, "name", m.name)
+		count++
+	}
+
+	return count, nil
+}
+
+// runMigration executes a migration and records it in one transaction,
+// or one after the other for noTransaction migrations
+func runMigration(db *sql.DB, body, record string, version int, name string) error {
+	if strings.HasPrefix(body, noTransaction) {
+		if _, err := db.Exec(body); err != nil {
+			return err
+		}
+		_, err := db.Exec(record, version, name)
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(body); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(record, version, name); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migrationStatus lists every embedded migration and when it was applied
+func migrationStatus(db *sql.DB) ([]migrationState, error) {
+	ml, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]migrationState, 0, len(ml))
+	for _, m := range ml {
+		s := migrationState{Version: m.version, Name: m.name}
+		if t, ok := applied[m.version]; ok {
+			s.Applied = &t
+		}
+		states = append(states, s)
+	}
+
+	return states, nil
+}
+
+// runMigrateCommand implements "migrate up", "migrate down [steps]"
+// and "migrate status"
+func runMigrateCommand(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up | down [steps] | status")
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := migrateUp(db)
+		fmt.Fprintf(out, "Applied %d migration(s)\n", n)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			s, err := strconv.Atoi(args[1])
+			if err != nil || s < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+			steps = s
+		}
+		n, err := migrateDown(db, steps)
+		fmt.Fprintf(out, "Reverted %d migration(s)\n", n)
+		return err
+	case "status":
+		states, err := migrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.Applied != nil {
+				applied = s.Applied.Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown migrate command: %s", args[0])
+}
@@ -10,28 +10,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"log"
+	"log/slog"
 	"time"
 )
 
 // A GenericError is the default error message that is generated.
-// For certain status codes there are more appropriate error structures.
+// Errors are RFC 7807 problem details served as application/problem+json
 //
 // swagger:response genericError
 type GenericError struct {
-	// The error message
+	// The problem
 	// in: body
-	Body struct {
-		// Code: integer code for error message
-		Code int32 `json:"code"`
-		// Message: Error message called with Method()
-		Message error `json:"message"`
-	} `json:"body"`
+	Body problem `json:"body"`
 }
 
 // Return list of userss
@@ -53,7 +48,7 @@ type test struct {
 
 // swagger:response metadata
 type metadata struct {
-	Test test `json:test`
+	Test test `json:"Test"`
 	// Id
 	Id string `json:"id"`
 }
@@ -62,8 +57,8 @@ type metadata struct {
 type users struct {
 	// UsersUUID into JSONB
 
-	UsersUUID string   `json:usersuuid`
-	Metadata  metadata `json:metadata`
+	UsersUUID string   `json:"UsersUUID"`
+	Metadata  metadata `json:"Metadata"`
 	// Id
 	Id string `json:"id"`
 	// Updated
@@ -83,23 +78,44 @@ type UsersResponse struct {
 }
 
 // updateUsers in database
-func (t *users) updateUsers(db *sql.DB, key string) error {
+func (t *users) updateUsers(ctx context.Context, db *sql.DB, namespace, key string) error {
+	defer observeDB(ctx, "updateUsers")()
+
+	if _, err := uuid.Parse(key); err != nil {
+		return errInvalidUUID(key)
+	}
+
 	update := `
 	UPDATE Acme.users
-    SET users = '%s'
-  WHERE usersUUID = '%s';`
+    SET users = $1
+  WHERE namespace = $2 AND usersUUID = $3;`
 
 	jb, err := json.Marshal(t)
 	if err != nil {
-		log.Println("marshall failed")
-		panic(err)
+		slog.ErrorContext(ctx, "Marshal failed", "error", err)
+		return err
 	}
 
-	statement := fmt.Sprintf(update, jb, key)
-	_, er1 := db.Query(statement)
+	if err := checkDocumentSize(jb); err != nil {
+		return err
+	}
+
+	er1 := runInTx(ctx, db, "updateUsers", func(tx *sql.Tx) error {
+		before, err := readUsersDocument(ctx, tx, namespace, key)
+		if err != nil {
+			return err
+		}
+		if before == nil {
+			return errNotFound("%s does not exist", key)
+		}
+		if _, err := tx.ExecContext(ctx, update, jb, namespace, key); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditUpdate, namespace, key, before, jb)
+	})
 
 	if er1 != nil {
-		log.Println("Update failed")
+		slog.ErrorContext(ctx, "Update failed", "key", key, "error", er1)
 		return er1
 	}
 
@@ -107,39 +123,88 @@ func (t *users) updateUsers(db *sql.DB, key string) error {
 }
 
 // createUsers in database
-func (t *users) createUsers(db *sql.DB) (string, error) {
+func (t *users) createUsers(ctx context.Context, db *sql.DB, namespace string) (string, error) {
+	defer observeDB(ctx, "createUsers")()
+
 	jb, err := json.Marshal(t)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	//  statement := fmt.Sprintf("INSERT INTO Acme.users(users) VALUES('%s') RETURNING UsersUUID", jb)
-	//  rows, er1 := db.Query(statement)
-	statement := `INSERT INTO Acme.users(users) VALUES($1) RETURNING UsersUUID;`
-	rows, er1 := db.Query(statement, jb)
+	//  rows, er1 := db.QueryContext(ctx, statement)
+	statement := `INSERT INTO Acme.users(namespace, users) VALUES($1, $2) RETURNING UsersUUID;`
+	var uid string
+	if err := checkDocumentSize(jb); err != nil {
+		return "", err
+	}
+
+	er1 := runInTx(ctx, db, "createUsers", func(tx *sql.Tx) error {
+		if err := checkRecordQuota(ctx, tx, namespace, 1); err != nil {
+			return err
+		}
+		if err := tx.QueryRowContext(ctx, statement, namespace, jb).Scan(&uid); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditCreate, namespace, uid, nil, jb)
+	})
 
 	if er1 != nil {
-		log.Printf("Insert failed for: %s", t.UsersUUID)
-		log.Printf("SQL Error: %s", er1)
+		slog.ErrorContext(ctx, "Insert failed", "key", t.UsersUUID, "error", er1)
 		return "", er1
 	}
 
-	defer rows.Close()
+	t.UsersUUID = uid
+	return t.UsersUUID, nil
 
-	for rows.Next() {
-		err := rows.Scan(&t.UsersUUID)
-		if err != nil {
-			return "", err
+}
+
+// createUsersDocuments stores already marshaled users documents in one
+// transaction, either all of them are created or none.  The UUIDs
+// assigned are returned in order
+func createUsersDocuments(ctx context.Context, db *sql.DB, namespace string, docs [][]byte) ([]string, error) {
+	defer observeDB(ctx, "createUsersDocuments")()
+
+	statement := `INSERT INTO Acme.users(namespace, users) VALUES($1, $2) RETURNING UsersUUID;`
+	for _, jb := range docs {
+		if err := checkDocumentSize(jb); err != nil {
+			return nil, err
 		}
 	}
 
-	return t.UsersUUID, nil
+	var uids []string
+	err := runInTx(ctx, db, "createUsersDocuments", func(tx *sql.Tx) error {
+		// Start over when the transaction is retried
+		uids = make([]string, 0, len(docs))
+		if err := checkRecordQuota(ctx, tx, namespace, len(docs)); err != nil {
+			return err
+		}
+
+		for _, jb := range docs {
+			var uid string
+			if err := tx.QueryRowContext(ctx, statement, namespace, jb).Scan(&uid); err != nil {
+				return err
+			}
+			if err := recordAudit(ctx, tx, AuditCreate, namespace, uid, nil, jb); err != nil {
+				return err
+			}
+			uids = append(uids, uid)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Insert failed", "error", err)
+		return nil, err
+	}
 
+	return uids, nil
 }
 
 // listUsers: return a list of users
 //
-func (t *users) listUsers(db *sql.DB, start, count int) ([]listResponse, error) {
+func (t *users) listUsers(ctx context.Context, db *sql.DB, namespace string, start, count int) ([]listResponse, error) {
+	defer observeDB(ctx, "listUsers")()
+
 	/*
 	   qry := `select uuid,
 	         users ->> 'active' as active,
@@ -147,9 +212,9 @@ func (t *users) listUsers(db *sql.DB, start, count int) ([]listResponse, error)
 	         from Acme.users LIMIT %d OFFSET %d;`
 	*/
 	qry := `select UsersUUID
-          from Acme.users LIMIT %d OFFSET %d;`
+          from Acme.users WHERE namespace = $1 LIMIT %d OFFSET %d;`
 	statement := fmt.Sprintf(qry, count, start)
-	rows, err := db.Query(statement)
+	rows, err := db.QueryContext(ctx, statement, namespace)
 
 	if err != nil {
 		return nil, err
@@ -164,7 +229,7 @@ func (t *users) listUsers(db *sql.DB, start, count int) ([]listResponse, error)
 		err := rows.Scan(&t.UUID)
 
 		if err != nil {
-			log.Printf("SQL rows.Scan failed: %s", err)
+			slog.ErrorContext(ctx, "SQL rows.Scan failed", "error", err)
 			return ul, err
 		}
 
@@ -174,25 +239,53 @@ func (t *users) listUsers(db *sql.DB, start, count int) ([]listResponse, error)
 	return ul, nil
 }
 
+// scanUsersDocuments: call fn with up to limit raw users documents
+//
+func scanUsersDocuments(ctx context.Context, db *sql.DB, namespace string, limit int, fn func([]byte) error) error {
+	defer observeDB(ctx, "scanUsersDocuments")()
+
+	statement := `SELECT users FROM Acme.users WHERE namespace = $1 LIMIT $2;`
+	rows, err := db.QueryContext(ctx, statement, namespace, limit)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var jb []byte
+		if err := rows.Scan(&jb); err != nil {
+			slog.ErrorContext(ctx, "SQL rows.Scan failed", "error", err)
+			return err
+		}
+		if err := fn(jb); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
 // getUsers: return a users based on the key
 //
-func (t *users) getUsers(db *sql.DB, key string, method int) error {
+func (t *users) getUsers(ctx context.Context, db *sql.DB, namespace, key string, method int) error {
+	defer observeDB(ctx, "getUsers")()
+
 	var statement string
 
 	switch method {
 	case UUID:
 		_, err := uuid.Parse(key)
 		if err != nil {
-			m := fmt.Sprintf("400: invalid UUID: %s", key)
-			return errors.New(m)
+			return errInvalidUUID(key)
 		}
 		statement = `
   SELECT UsersUUID, users
   FROM Acme.users
-  WHERE UsersUUID = $1;`
+  WHERE namespace = $1 AND UsersUUID = $2;`
 	}
 
-	row := db.QueryRow(statement, key)
+	row := db.QueryRowContext(ctx, statement, namespace, key)
 
 	// Fill in mapper
 	var jb []byte
@@ -200,19 +293,18 @@ func (t *users) getUsers(db *sql.DB, key string, method int) error {
 	switch err := row.Scan(&uid, &jb); err {
 
 	case sql.ErrNoRows:
-		m := fmt.Sprintf("404:name %s does not exist", key)
-		return errors.New(m)
+		return errNotFound("%s does not exist", key)
 	case nil:
 		err = json.Unmarshal(jb, t)
 		if err != nil {
-			m := fmt.Sprintf("400:unmarshal failed %s", key)
-			return errors.New(m)
+			slog.ErrorContext(ctx, "Unmarshal failed", "key", key, "error", err)
+			return err
 		}
 		t.UsersUUID = uid
 		break
 	default:
-		//Some error to catch
-		panic(err)
+		slog.ErrorContext(ctx, "Select failed", "key", key, "error", err)
+		return err
 	}
 
 	return nil
@@ -220,17 +312,35 @@ func (t *users) getUsers(db *sql.DB, key string, method int) error {
 
 // deleteUsers: return a users based on UID
 //
-func (t *users) deleteUsers(db *sql.DB, key string) error {
-	statement := `DELETE FROM Acme.users WHERE UsersUUID = $1;`
-	result, err := db.Exec(statement, key)
-	c, e := result.RowsAffected()
+func (t *users) deleteUsers(ctx context.Context, db *sql.DB, namespace, key string) error {
+	defer observeDB(ctx, "deleteUsers")()
 
-	if e == nil && c == 0 {
-		em := fmt.Sprintf("UUID %s does not exist", key)
-		log.Println(em)
-		log.Println(e)
-		return errors.New(em)
+	if _, err := uuid.Parse(key); err != nil {
+		return errInvalidUUID(key)
 	}
 
-	return err
+	statement := `DELETE FROM Acme.users WHERE namespace = $1 AND UsersUUID = $2 RETURNING users;`
+	var before []byte
+	err := runInTx(ctx, db, "deleteUsers", func(tx *sql.Tx) error {
+		before = nil
+		err := tx.QueryRowContext(ctx, statement, namespace, key).Scan(&before)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditDelete, namespace, key, before, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	if before == nil {
+		err := errNotFound("UUID %s does not exist", key)
+		slog.WarnContext(ctx, "Delete failed", "key", key, "error", err)
+		return err
+	}
+
+	return nil
 }
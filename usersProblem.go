@@ -0,0 +1,199 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// ProblemContentType is the media type of error responses, RFC 7807
+const ProblemContentType string = "application/problem+json"
+
+// problemTypeBase prefixes the code of a problem to form its type
+const problemTypeBase string = "urn:pavedroad:users:problem:"
+
+// Error codes, they are stable so clients can match them instead of
+// the detail text
+const (
+	CodeInvalidRequest   string = "invalid-request"
+	CodeInvalidUUID      string = "invalid-uuid"
+	CodeUnauthorized     string = "unauthorized"
+	CodeForbidden        string = "forbidden"
+	CodeNotFound         string = "not-found"
+	CodeMethodNotAllowed string = "method-not-allowed"
+	CodeConflict         string = "conflict"
+	CodeRateLimited      string = "rate-limited"
+	CodeQuotaExceeded    string = "quota-exceeded"
+	CodeInternal         string = "internal"
+	CodeStoreUnavailable string = "store-unavailable"
+	CodeTimeout          string = "timeout"
+)
+
+// statusCodes are the codes of errors only known by their status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          CodeInvalidRequest,
+	http.StatusUnauthorized:        CodeUnauthorized,
+	http.StatusForbidden:           CodeForbidden,
+	http.StatusNotFound:            CodeNotFound,
+	http.StatusMethodNotAllowed:    CodeMethodNotAllowed,
+	http.StatusConflict:            CodeConflict,
+	http.StatusTooManyRequests:     CodeRateLimited,
+	http.StatusInsufficientStorage: CodeQuotaExceeded,
+	http.StatusInternalServerError: CodeInternal,
+	http.StatusServiceUnavailable:  CodeStoreUnavailable,
+	http.StatusGatewayTimeout:      CodeTimeout,
+}
+
+// problem is the body of every error response
+//
+// swagger:model problem
+type problem struct {
+	// Type: URI identifying the kind of problem, problemTypeBase + code
+	Type string `json:"type"`
+	// Title: the HTTP status text
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail: explains this occurrence, it may change between releases
+	Detail string `json:"detail,omitempty"`
+	// Code: stable name of the problem, i.e. not-found
+	Code string `json:"code"`
+	// RequestID: finds the matching log records
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// usersError is an error the caller can act on, model functions return
+// it and respondWithModelError reports it with its status and code
+type usersError struct {
+	status int
+	code   string
+	detail string
+}
+
+func (e *usersError) Error() string {
+	return e.detail
+}
+
+// newUsersError formats the detail of an error with status and code
+func newUsersError(status int, code string, format string, args ...interface{}) error {
+	return &usersError{status: status, code: code, detail: fmt.Sprintf(format, args...)}
+}
+
+// errInvalid reports a request that can not be carried out as given
+func errInvalid(format string, args ...interface{}) error {
+	return newUsersError(http.StatusBadRequest, CodeInvalidRequest, format, args...)
+}
+
+// errInvalidUUID reports a key that is not a UUID
+func errInvalidUUID(key string) error {
+	return newUsersError(http.StatusBadRequest, CodeInvalidUUID, "invalid UUID: %s", key)
+}
+
+// errNotFound reports a record, snapshot, or key that does not exist
+func errNotFound(format string, args ...interface{}) error {
+	return newUsersError(http.StatusNotFound, CodeNotFound, format, args...)
+}
+
+// errConflict reports a request that clashes with stored state
+func errConflict(format string, args ...interface{}) error {
+	return newUsersError(http.StatusConflict, CodeConflict, format, args...)
+}
+
+// errQuota reports a change that would exceed a storage quota
+func errQuota(format string, args ...interface{}) error {
+	return newUsersError(http.StatusInsufficientStorage, CodeQuotaExceeded, format, args...)
+}
+
+// respondWithModelError reports an error returned by a model function.
+// Errors that are not a usersError are logged and hidden from callers
+func respondWithModelError(w http.ResponseWriter, err error) {
+	var ue *usersError
+	switch {
+	case errors.As(err, &ue):
+		respondWithProblem(w, ue.status, ue.code, ue.detail)
+	case errors.Is(err, context.DeadlineExceeded):
+		// Checked first, it is also a net.Error
+		respondWithError(w, http.StatusGatewayTimeout, "request timed out")
+	case storeUnavailable(err):
+		slog.Error("Store unavailable", "error", err)
+		respondUnavailable(w, currentConfig().Database.Breaker.Cooldown)
+	default:
+		slog.Error("Request failed", "request_id", w.Header().Get(RequestIDHeader), "error", err)
+		respondWithError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+// respondWithError reports a problem known only by its status
+func respondWithError(w http.ResponseWriter, status int, detail string) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = CodeInternal
+	}
+	respondWithProblem(w, status, code, detail)
+}
+
+// respondWithProblem writes a problem details response, it includes the
+// request ID so callers can find the matching log records
+func respondWithProblem(w http.ResponseWriter, status int, code, detail string) {
+	p := problem{
+		Type:      problemTypeBase + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Code:      code,
+		RequestID: w.Header().Get(RequestIDHeader),
+	}
+
+	response, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(status)
+	_, _ = w.Write(response)
+}
+
+// recoverMiddleware answers 500 instead of dropping the connection when
+// a handler panics, and logs the stack
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// The server uses this to abort a response on purpose
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			slog.ErrorContext(r.Context(), "Handler panicked", "method", r.Method, "path", r.URL.Path,
+				"panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			if sr.status == 0 {
+				respondWithError(sr, http.StatusInternalServerError, "internal error")
+			}
+		}()
+
+		next.ServeHTTP(sr, r)
+	})
+}
+
+// notFoundHandler answers requests that match no route
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, http.StatusNotFound, "no route matches "+r.URL.Path)
+}
+
+// methodNotAllowedHandler answers requests for a route that does not
+// accept their method
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
@@ -0,0 +1,166 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles bound to identities per namespace
+const (
+	// RoleViewer reads records
+	RoleViewer string = "viewer"
+	// RoleEditor reads and changes records
+	RoleEditor string = "editor"
+	// RoleAdmin also reads the audit log of its namespaces, and manages
+	// API keys when bound to every namespace
+	RoleAdmin string = "admin"
+)
+
+// VerbAdmin is only granted by the admin role, it is not a request verb
+const VerbAdmin string = "admin"
+
+// AnonymousIdentity names callers without credentials in bindings
+const AnonymousIdentity string = "anonymous"
+
+// AllNamespaces in a binding matches every namespace
+const AllNamespaces string = "*"
+
+// roleVerbs are the verbs each role grants
+var roleVerbs = map[string][]string{
+	RoleViewer: {VerbGet, VerbList},
+	RoleEditor: {VerbGet, VerbList, VerbCreate, VerbUpdate, VerbDelete},
+	RoleAdmin:  {VerbGet, VerbList, VerbCreate, VerbUpdate, VerbDelete, VerbAdmin},
+}
+
+// accessDecision answers whether an identity can do a verb in a namespace
+//
+// swagger:model accessDecision
+type accessDecision struct {
+	Identity  string `json:"identity"`
+	Verb      string `json:"verb"`
+	Namespace string `json:"namespace"`
+	Allowed   bool   `json:"allowed"`
+	// Reason: the role or setting that decided
+	Reason string `json:"reason"`
+}
+
+// can decides whether name may do verb in namespace.  Identities in
+// auth.admins can do everything; with rbac disabled everyone can do
+// everything but admin
+func (c *usersConfig) can(name, verb, namespace string) accessDecision {
+	d := accessDecision{Identity: name, Verb: verb, Namespace: namespace}
+
+	switch {
+	case contains(c.Auth.Admins, name):
+		d.Allowed, d.Reason = true, "listed in auth.admins"
+		return d
+	case !c.RBAC.Enabled && verb != VerbAdmin:
+		d.Allowed, d.Reason = true, "rbac is disabled"
+		return d
+	}
+
+	for _, b := range c.RBAC.Bindings {
+		if b.Identity != name || !contains(roleVerbs[b.Role], verb) {
+			continue
+		}
+		if contains(b.Namespaces, namespace) || contains(b.Namespaces, AllNamespaces) {
+			d.Allowed, d.Reason = true, "role "+b.Role
+			return d
+		}
+	}
+
+	d.Reason = "no role grants " + verb
+	return d
+}
+
+// authorize returns why the caller of r can not do verb in namespace,
+// or "" when it can.  API keys are limited by their own scope
+func authorize(r *http.Request, verb, namespace string) string {
+	id, ok := identityFrom(r.Context())
+	if ok && id.key != nil {
+		if !id.key.allows(namespace, verb) {
+			return fmt.Sprintf("API key %s can not %s in namespace %s", id.Name, verb, namespace)
+		}
+		return ""
+	}
+
+	name := AnonymousIdentity
+	if ok {
+		name = id.Name
+	}
+	if d := currentConfig().can(name, verb, namespace); !d.Allowed {
+		slog.WarnContext(r.Context(), "Access denied", "verb", verb, "namespace", namespace, "reason", d.Reason)
+		return fmt.Sprintf("%s can not %s in namespace %s", name, verb, namespace)
+	}
+	return ""
+}
+
+// rbacMiddleware refuses namespaced requests the caller's roles do not
+// allow
+func rbacMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		namespace := mux.Vars(r)["namespace"]
+		if namespace == "" || !strings.HasPrefix(r.URL.Path, UsersAPIVersion+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if reason := authorize(r, requestVerb(r), namespace); reason != "" {
+			respondWithError(w, http.StatusForbidden, reason)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin refuses callers without the admin role on every
+// namespace, API keys are never admins
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	id, ok := identityFrom(r.Context())
+	if !ok {
+		respondUnauthorized(w, "Bearer", "authentication required")
+		return false
+	}
+
+	if id.key == nil && currentConfig().can(id.Name, VerbAdmin, AllNamespaces).Allowed {
+		return true
+	}
+	respondWithError(w, http.StatusForbidden, id.Name+" is not an admin")
+	return false
+}
+
+// validateBindings checks the rbac section
+func (rc rbacConfig) validateBindings() []error {
+	var errs []error
+	for i, b := range rc.Bindings {
+		name := fmt.Sprintf("rbac.bindings[%d]", i)
+		if b.Identity == "" {
+			errs = append(errs, fmt.Errorf("%s.identity: is required", name))
+		}
+		if _, ok := roleVerbs[b.Role]; !ok {
+			errs = append(errs, fmt.Errorf("%s.role: %q must be viewer, editor, or admin", name, b.Role))
+		}
+		if len(b.Namespaces) == 0 {
+			errs = append(errs, fmt.Errorf("%s.namespaces: at least one namespace is required", name))
+		}
+		for _, ns := range b.Namespaces {
+			if ns != AllNamespaces && !namespaceRE.MatchString(ns) {
+				errs = append(errs, fmt.Errorf("%s.namespaces: invalid namespace %q", name, ns))
+			}
+		}
+	}
+	return errs
+}
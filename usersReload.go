@@ -0,0 +1,208 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AdminPath prefixes endpoints used to operate the service
+const AdminPath string = "/admin"
+
+// configWatchInterval is how often the config file is checked for changes
+const configWatchInterval = 5 * time.Second
+
+// activeConfig is the configuration in use and its reload version
+type activeConfig struct {
+	usersConfig
+	version  int
+	loaded   time.Time
+	checksum string
+	// settings changed in the source that need a restart
+	pending []string
+}
+
+// active is replaced as a whole on reload so readers never see a
+// partially applied configuration
+var active atomic.Pointer[activeConfig]
+
+// reloadMu serializes reloads from SIGHUP and the file watcher
+var reloadMu sync.Mutex
+
+// configVersion is returned by the admin config endpoint
+//
+// swagger:model configVersion
+type configVersion struct {
+	// Version: starts at 1 and increases with each reload
+	Version int `json:"version"`
+	// Loaded: when this version was applied
+	Loaded time.Time `json:"loaded"`
+	// Checksum: identifies the settings, secrets excluded
+	Checksum string `json:"checksum"`
+	// RestartRequired: changed settings that apply after a restart
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// currentConfig returns the active configuration, callers must not
+// modify it
+func currentConfig() *usersConfig {
+	if ac := active.Load(); ac != nil {
+		return &ac.usersConfig
+	}
+	c := defaultConfig()
+	return &c
+}
+
+// setConfig makes c the active configuration with the next version
+func setConfig(c usersConfig) *activeConfig {
+	return storeConfig(c, nil)
+}
+
+// storeConfig makes c active and records the settings that wait for
+// a restart
+func storeConfig(c usersConfig, pending []string) *activeConfig {
+	if pending == nil {
+		pending = []string{}
+	}
+
+	ac := &activeConfig{usersConfig: c, version: 1, loaded: time.Now().UTC(), pending: pending}
+	if prev := active.Load(); prev != nil {
+		ac.version = prev.version + 1
+	}
+
+	if yb, err := yaml.Marshal(c.redacted()); err == nil {
+		sum := sha256.Sum256(yb)
+		ac.checksum = hex.EncodeToString(sum[:6])
+	}
+
+	active.Store(ac)
+	return ac
+}
+
+// keepStatic copies settings that are only read at startup from old
+// into c and returns the names of those that differed
+func (c *usersConfig) keepStatic(old *usersConfig) []string {
+	changed := []string{}
+
+	// Pool limits are applied to the open pool and the breaker reads
+	// its settings on use
+	pool, breaker := c.Database.Pool, c.Database.Breaker
+	c.Database.Pool, c.Database.Breaker = old.Database.Pool, old.Database.Breaker
+	if c.Database != old.Database {
+		changed = append(changed, "database")
+		c.Database = old.Database
+	}
+	c.Database.Pool, c.Database.Breaker = pool, breaker
+	if c.HTTP.Host != old.HTTP.Host || c.HTTP.Port != old.HTTP.Port {
+		changed = append(changed, "http.host", "http.port")
+		c.HTTP.Host, c.HTTP.Port = old.HTTP.Host, old.HTTP.Port
+	}
+	if c.HTTP.ReadTimeout != old.HTTP.ReadTimeout || c.HTTP.WriteTimeout != old.HTTP.WriteTimeout {
+		changed = append(changed, "http.readTimeout", "http.writeTimeout")
+		c.HTTP.ReadTimeout, c.HTTP.WriteTimeout = old.HTTP.ReadTimeout, old.HTTP.WriteTimeout
+	}
+	if c.TLS.CertFile != old.TLS.CertFile || c.TLS.KeyFile != old.TLS.KeyFile ||
+		c.TLS.ClientCAFile != old.TLS.ClientCAFile || c.TLS.ClientAuth != old.TLS.ClientAuth {
+		changed = append(changed, "tls")
+		c.TLS.CertFile, c.TLS.KeyFile = old.TLS.CertFile, old.TLS.KeyFile
+		c.TLS.ClientCAFile, c.TLS.ClientAuth = old.TLS.ClientCAFile, old.TLS.ClientAuth
+	}
+	if c.Log.File != old.Log.File {
+		changed = append(changed, "log.file")
+		c.Log.File = old.Log.File
+	}
+	if c.Trace != old.Trace {
+		changed = append(changed, "trace")
+		c.Trace = old.Trace
+	}
+
+	return changed
+}
+
+// reloadConfig reads every source again and applies the settings that
+// can change at run time.  An invalid configuration is rejected and the
+// active one is kept
+func (a *UsersApp) reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	c, err := loadConfig(a.flags)
+	if err != nil {
+		return err
+	}
+
+	// Keys are read again so rotated ones are picked up
+	v, err := newJWTVerifier(c.Auth.JWT)
+	if err != nil {
+		return err
+	}
+
+	pending := c.keepStatic(currentConfig())
+	ac := storeConfig(c, pending)
+	logLevel.Set(c.logLevel())
+	a.applyPool()
+	a.jwt.Store(v)
+
+	slog.Info("Configuration reloaded", "version", ac.version, "checksum", ac.checksum)
+	if len(pending) > 0 {
+		slog.Warn("Restart to apply changed settings", "settings", pending)
+	}
+
+	return nil
+}
+
+// watchConfigFile reloads when the file's modification time or size
+// changes, stat follows the symlinks Kubernetes swaps on ConfigMap updates
+func (a *UsersApp) watchConfigFile(ctx context.Context, path string) {
+	last, _ := os.Stat(path)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			// Being replaced, try again on the next tick
+			continue
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+
+		if err := a.reloadConfig(); err != nil {
+			slog.Error("Configuration reload failed", "error", err)
+		}
+	}
+}
+
+// initializeAdminRoutes adds the endpoints under AdminPath
+func (a *UsersApp) initializeAdminRoutes() {
+	a.Router.HandleFunc(AdminPath+"/config", a.getConfigVersion).Methods("GET")
+	a.Router.HandleFunc(AdminPath+"/apikeys", a.createAPIKey).Methods("POST")
+	a.Router.HandleFunc(AdminPath+"/apikeys", a.listAPIKeys).Methods("GET")
+	a.Router.HandleFunc(AdminPath+"/apikeys/{id}", a.revokeAPIKey).Methods("DELETE")
+	a.Router.HandleFunc(AdminPath+"/can-i", a.canI).Methods("GET")
+	a.Router.HandleFunc(AdminPath+"/audit", a.listAudit).Methods("GET")
+}
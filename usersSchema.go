@@ -0,0 +1,350 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Inferred column types, ColString and ColTime are shared
+// with the generator
+const (
+	ColInteger string = "integer"
+	ColNumber  string = "number"
+	ColBoolean string = "boolean"
+	ColArray   string = "array"
+	ColJSON    string = "json"
+)
+
+const (
+	// defaultSchemaSample is the number of stored documents scanned
+	defaultSchemaSample int = 1000
+	// maxSchemaSample limits the limit parameter
+	maxSchemaSample int = 100000
+)
+
+// schemaResponse is a tables definition in testDataMgr.yaml format
+//
+// swagger:response schemaResponse
+type schemaResponse struct {
+	// in: body
+	Body schemaDefinition
+}
+
+// schemaDefinition is the tables section of testDataMgr.yaml
+type schemaDefinition struct {
+	Tables []schemaTable `yaml:"tables"`
+}
+
+// schemaTable is one table, nested objects become child tables
+type schemaTable struct {
+	Columns      []schemaColumn `yaml:"columns"`
+	ParentTables string         `yaml:"parent-tables"`
+	TableName    string         `yaml:"table-name"`
+	TableType    string         `yaml:"table-type,omitempty"`
+}
+
+// schemaColumn is a column definition as used by roadctl
+type schemaColumn struct {
+	Constraints string `yaml:"constraints"`
+	MappedName  string `yaml:"mapped-name"`
+	Modifiers   string `yaml:"modifiers"`
+	Name        string `yaml:"name"`
+	Type        string `yaml:"type"`
+}
+
+// MarshalYAML writes columns in flow style like testDataMgr.yaml
+func (c schemaColumn) MarshalYAML() (interface{}, error) {
+	type plain schemaColumn
+	n := &yaml.Node{}
+	if err := n.Encode(plain(c)); err != nil {
+		return nil, err
+	}
+	n.Style = yaml.FlowStyle
+	return n, nil
+}
+
+// inferColumn tracks what was observed for one column
+type inferColumn struct {
+	types map[string]int
+	seen  int
+	nulls int
+}
+
+// inferTable tracks the columns seen for one object level
+type inferTable struct {
+	name    string
+	parent  string
+	objects int
+	columns map[string]*inferColumn
+}
+
+// schemaInferrer builds a schema from sample documents
+type schemaInferrer struct {
+	root   string
+	order  []string
+	tables map[string]*inferTable
+}
+
+// newSchemaInferrer returns an inferrer using root as the top table name
+func newSchemaInferrer(root string) *schemaInferrer {
+	return &schemaInferrer{root: root, tables: map[string]*inferTable{}}
+}
+
+// addDocument adds one JSON document to the sample
+func (s *schemaInferrer) addDocument(jb []byte) error {
+	d := json.NewDecoder(bytes.NewReader(jb))
+	d.UseNumber()
+
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return err
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("document is not a JSON object")
+	}
+
+	s.addObject(s.root, "", obj)
+	return nil
+}
+
+// addNDJSON adds one document per non empty line and returns
+// the number of documents read
+func (s *schemaInferrer) addNDJSON(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	n := 0
+	line := 0
+	for scanner.Scan() {
+		line++
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		if err := s.addDocument(b); err != nil {
+			return n, fmt.Errorf("line %d: %s", line, err)
+		}
+		n++
+	}
+
+	return n, scanner.Err()
+}
+
+// addObject records the keys of one object at a table level
+func (s *schemaInferrer) addObject(name, parent string, obj map[string]interface{}) {
+	t, ok := s.tables[name]
+	if !ok {
+		t = &inferTable{name: name, parent: parent, columns: map[string]*inferColumn{}}
+		s.tables[name] = t
+		s.order = append(s.order, name)
+	}
+	t.objects++
+
+	for k, v := range obj {
+		// The key is assigned by the database and is not a column
+		if name == s.root && strings.EqualFold(k, "usersuuid") {
+			continue
+		}
+
+		switch val := v.(type) {
+		case map[string]interface{}:
+			s.addObject(k, name, val)
+			continue
+		case []interface{}:
+			if children, ok := objectArray(val); ok {
+				for _, c := range children {
+					s.addObject(k, name, c)
+				}
+				continue
+			}
+		}
+
+		c, ok := t.columns[k]
+		if !ok {
+			c = &inferColumn{types: map[string]int{}}
+			t.columns[k] = c
+		}
+		c.seen++
+
+		if v == nil {
+			c.nulls++
+			continue
+		}
+		c.types[valueType(v)]++
+	}
+}
+
+// objectArray returns the elements of a non empty array of objects
+func objectArray(a []interface{}) ([]map[string]interface{}, bool) {
+	if len(a) == 0 {
+		return nil, false
+	}
+
+	objs := make([]map[string]interface{}, 0, len(a))
+	for _, e := range a {
+		o, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		objs = append(objs, o)
+	}
+	return objs, true
+}
+
+// valueType maps a decoded JSON value to a column type
+func valueType(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		if _, err := time.Parse(time.RFC3339Nano, val); err == nil {
+			return ColTime
+		}
+		return ColString
+	case json.Number:
+		if _, err := val.Int64(); err == nil {
+			return ColInteger
+		}
+		return ColNumber
+	case bool:
+		return ColBoolean
+	case []interface{}:
+		return ColArray
+	}
+	return ColJSON
+}
+
+// columnType resolves the types observed for a column into one
+func (c *inferColumn) columnType() string {
+	switch len(c.types) {
+	case 0:
+		// Only nulls were seen
+		return ColString
+	case 1:
+		for t := range c.types {
+			return t
+		}
+	case 2:
+		if c.types[ColInteger] > 0 && c.types[ColNumber] > 0 {
+			return ColNumber
+		}
+		if c.types[ColTime] > 0 && c.types[ColString] > 0 {
+			return ColString
+		}
+	}
+	return ColJSON
+}
+
+// schema returns the tables inferred so far
+func (s *schemaInferrer) schema() schemaDefinition {
+	def := schemaDefinition{Tables: []schemaTable{}}
+
+	for _, name := range s.order {
+		t := s.tables[name]
+		st := schemaTable{TableName: t.name, ParentTables: t.parent, Columns: []schemaColumn{}}
+		if t.parent == "" {
+			st.TableType = "jsonb"
+		}
+
+		keys := make([]string, 0, len(t.columns))
+		for k := range t.columns {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			c := t.columns[k]
+			sc := schemaColumn{Name: k, MappedName: snakeCase(k), Type: c.columnType()}
+			if c.seen == t.objects && c.nulls == 0 {
+				sc.Constraints = "not-null"
+			}
+			st.Columns = append(st.Columns, sc)
+		}
+
+		def.Tables = append(def.Tables, st)
+	}
+
+	return def
+}
+
+// inferSchemaFile prints the schema inferred from an NDJSON file,
+// "-" reads from stdin
+func inferSchemaFile(path string, out io.Writer) error {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	s := newSchemaInferrer(UsersResourceType)
+	if _, err := s.addNDJSON(in); err != nil {
+		return err
+	}
+
+	yb, err := s.yaml()
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(yb)
+	return err
+}
+
+// yaml returns the inferred schema in testDataMgr.yaml format
+func (s *schemaInferrer) yaml() ([]byte, error) {
+	var b bytes.Buffer
+	e := yaml.NewEncoder(&b)
+	e.SetIndent(2)
+	if err := e.Encode(s.schema()); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// snakeCase converts camelCase or kebab-case names to snake_case
+func snakeCase(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+
+	for i, r := range runes {
+		switch {
+		case r == '-' || r == ' ' || r == '.':
+			b.WriteRune('_')
+		case unicode.IsUpper(r):
+			if i > 0 && (unicode.IsLower(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b.WriteRune('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
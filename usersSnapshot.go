@@ -0,0 +1,183 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"regexp"
+	"time"
+)
+
+// snapshotNameRE limits snapshot names to URL friendly values
+var snapshotNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// A snapshot is a named copy of all users in a namespace
+//
+// swagger:model snapshot
+type snapshot struct {
+	// Name: unique within the namespace
+	Name string `json:"name"`
+	// Namespace: the namespace that was captured
+	Namespace string `json:"namespace"`
+	// Records: number of users in the snapshot
+	Records int64 `json:"records"`
+	// Created: when the snapshot was taken
+	Created time.Time `json:"created"`
+}
+
+// snapshotList model
+//
+// swagger:response snapshotList
+type snapshotList struct {
+	// in: body
+	Body []snapshot
+}
+
+// createSnapshot copies every users record in the namespace into
+// the snapshot tables
+func (s *snapshot) createSnapshot(ctx context.Context, db *sql.DB) error {
+	defer observeDB(ctx, "createSnapshot")()
+
+	if !snapshotNameRE.MatchString(s.Name) {
+		return errInvalid("invalid snapshot name: %s", s.Name)
+	}
+
+	s.Created = time.Now().UTC()
+
+	// The primary key rejects an existing name
+	header := `
+  INSERT INTO Acme.usersSnapshots(namespace, name, created, records)
+  VALUES ($1, $2, $3, 0) ON CONFLICT DO NOTHING;`
+	copyRecords := `
+  INSERT INTO Acme.usersSnapshotRecords(namespace, name, UsersUUID, users)
+  SELECT namespace, $2, UsersUUID, users FROM Acme.users WHERE namespace = $1;`
+	count := `UPDATE Acme.usersSnapshots SET records = $3 WHERE namespace = $1 AND name = $2;`
+
+	return runInTx(ctx, db, "createSnapshot", func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, header, s.Namespace, s.Name, s.Created)
+		if err != nil {
+			return err
+		}
+		if c, err := result.RowsAffected(); err == nil && c == 0 {
+			return errConflict("snapshot %s already exists", s.Name)
+		}
+
+		result, err = tx.ExecContext(ctx, copyRecords, s.Namespace, s.Name)
+		if err != nil {
+			return err
+		}
+		if s.Records, err = result.RowsAffected(); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, count, s.Namespace, s.Name, s.Records)
+		return err
+	})
+}
+
+// listSnapshots returns the snapshots taken of a namespace
+func listSnapshots(ctx context.Context, db *sql.DB, namespace string) ([]snapshot, error) {
+	defer observeDB(ctx, "listSnapshots")()
+
+	statement := `
+  SELECT name, namespace, records, created FROM Acme.usersSnapshots
+  WHERE namespace = $1 ORDER BY created;`
+	rows, err := db.QueryContext(ctx, statement, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sl := []snapshot{}
+	for rows.Next() {
+		var s snapshot
+		if err := rows.Scan(&s.Name, &s.Namespace, &s.Records, &s.Created); err != nil {
+			slog.ErrorContext(ctx, "SQL rows.Scan failed", "error", err)
+			return sl, err
+		}
+		sl = append(sl, s)
+	}
+
+	return sl, rows.Err()
+}
+
+// restoreSnapshot replaces the contents of the namespace with the
+// snapshot in a single transaction
+func (s *snapshot) restoreSnapshot(ctx context.Context, db *sql.DB) error {
+	defer observeDB(ctx, "restoreSnapshot")()
+
+	header := `
+  SELECT records, created FROM Acme.usersSnapshots
+  WHERE namespace = $1 AND name = $2;`
+	restore := `
+  INSERT INTO Acme.users(namespace, UsersUUID, users)
+  SELECT namespace, UsersUUID, users FROM Acme.usersSnapshotRecords
+  WHERE namespace = $1 AND name = $2;`
+	// One entry per record the restore adds, removes, or changes
+	audit := `
+  INSERT INTO Acme.usersAudit(occurred, identity, method, client, userAgent, requestID,
+    namespace, UsersUUID, action, beforeDoc, afterDoc)
+  SELECT $3::TIMESTAMPTZ, $4::STRING, $5::STRING, $6::STRING, $7::STRING, $8::STRING,
+    $1, COALESCE(u.UsersUUID, s.UsersUUID), $9::STRING, u.users, s.users
+  FROM (SELECT UsersUUID, users FROM Acme.users WHERE namespace = $1) AS u
+  FULL OUTER JOIN (SELECT UsersUUID, users FROM Acme.usersSnapshotRecords
+    WHERE namespace = $1 AND name = $2) AS s ON u.UsersUUID = s.UsersUUID
+  WHERE u.users IS DISTINCT FROM s.users;`
+
+	return runInTx(ctx, db, "restoreSnapshot", func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, header, s.Namespace, s.Name).Scan(&s.Records, &s.Created)
+		if err == sql.ErrNoRows {
+			return errNotFound("snapshot %s does not exist", s.Name)
+		}
+		if err != nil {
+			return err
+		}
+
+		args := append([]interface{}{s.Namespace, s.Name}, auditMetadata(ctx)...)
+		if _, err := tx.ExecContext(ctx, audit, append(args, AuditRestore)...); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM Acme.users WHERE namespace = $1;`, s.Namespace); err != nil {
+			return err
+		}
+		if err := checkRecordQuota(ctx, tx, s.Namespace, int(s.Records)); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, restore, s.Namespace, s.Name)
+		return err
+	})
+}
+
+// deleteSnapshot removes a snapshot and its records
+func (s *snapshot) deleteSnapshot(ctx context.Context, db *sql.DB) error {
+	defer observeDB(ctx, "deleteSnapshot")()
+
+	records := `DELETE FROM Acme.usersSnapshotRecords WHERE namespace = $1 AND name = $2;`
+	header := `DELETE FROM Acme.usersSnapshots WHERE namespace = $1 AND name = $2;`
+
+	return runInTx(ctx, db, "deleteSnapshot", func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, records, s.Namespace, s.Name); err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, header, s.Namespace, s.Name)
+		if err != nil {
+			return err
+		}
+		if c, err := result.RowsAffected(); err == nil && c == 0 {
+			return errNotFound("snapshot %s does not exist", s.Name)
+		}
+		return nil
+	})
+}
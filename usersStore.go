@@ -0,0 +1,227 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Store circuit breaker states
+const (
+	// BreakerClosed passes requests to the store
+	BreakerClosed string = "closed"
+	// BreakerOpen rejects requests until the cooldown ends
+	BreakerOpen string = "open"
+	// BreakerHalfOpen lets one request through to test the store
+	BreakerHalfOpen string = "half-open"
+)
+
+// Backoff between startup connection attempts
+const (
+	connectRetryBase = 500 * time.Millisecond
+	connectRetryMax  = 10 * time.Second
+)
+
+// breakerOpen reports the breaker state to Prometheus
+var breakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "users_db_breaker_open",
+	Help: "1 while the store circuit breaker rejects requests.",
+})
+
+// storeBreaker stops sending requests to a store that keeps failing
+// so callers get a fast 503 instead of waiting on timeouts.  It opens
+// after database.breaker.failures consecutive failures and once
+// database.breaker.cooldown passed a single request pings the store,
+// the breaker only closes when the ping succeeds
+type storeBreaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+// allow reports whether a request may use the store, when it may not
+// the time left until the next probe is returned.  probe is true for
+// the request that must ping the store and report it to probed
+func (b *storeBreaker) allow() (wait time.Duration, probe bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		wait := currentConfig().Database.Breaker.Cooldown - time.Since(b.openedAt)
+		if wait > 0 {
+			return wait, false, false
+		}
+		b.state = BreakerHalfOpen
+		slog.Info("Store circuit breaker half-open")
+		return 0, true, true
+	case BreakerHalfOpen:
+		// The probe has not finished yet
+		return currentConfig().Database.Breaker.Cooldown, false, false
+	}
+	return 0, false, true
+}
+
+// probed closes the breaker when the ping of the store succeeded and
+// opens it again when it failed
+func (b *storeBreaker) probed(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !ok {
+		b.failures++
+		b.open()
+		return
+	}
+
+	slog.Info("Store circuit breaker closed")
+	b.state = BreakerClosed
+	b.failures = 0
+	breakerOpen.Set(0)
+}
+
+// done records the outcome of a request allow let through, a success
+// only restarts the count of consecutive failures
+func (b *storeBreaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.state == BreakerClosed {
+			b.failures = 0
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= currentConfig().Database.Breaker.Failures {
+		b.open()
+	}
+}
+
+// trip opens the breaker, it is used when the service starts without
+// a database
+func (b *storeBreaker) trip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open()
+}
+
+// open must be called with mu held
+func (b *storeBreaker) open() {
+	if b.state != BreakerOpen {
+		slog.Warn("Store circuit breaker open", "failures", b.failures)
+	}
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	breakerOpen.Set(1)
+}
+
+// storeUnavailable reports whether err means the store could not be
+// reached, as opposed to rejecting the request
+func storeUnavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// Connection exceptions and server shutting down or starting up
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Class() == "08" || pqErr.Code.Class() == "57"
+	}
+
+	return false
+}
+
+// respondUnavailable answers 503 and tells the caller when to retry
+func respondUnavailable(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithError(w, http.StatusServiceUnavailable, "store unavailable")
+}
+
+// storeMiddleware puts the circuit breaker in front of the API routes.
+// Requests answered with 503 or 504 count as store failures, after the
+// cooldown the first request pings the store before it is served
+func (a *UsersApp) storeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, UsersAPIVersion+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		wait, probe, ok := a.breaker.allow()
+		if !ok {
+			respondUnavailable(w, wait)
+			return
+		}
+		if probe {
+			ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+			err := a.DB.PingContext(ctx)
+			cancel()
+			a.breaker.probed(err == nil)
+			if err != nil {
+				slog.WarnContext(r.Context(), "Store probe failed", "error", err)
+				respondUnavailable(w, currentConfig().Database.Breaker.Cooldown)
+				return
+			}
+		}
+
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			a.breaker.done(sr.status == http.StatusServiceUnavailable || sr.status == http.StatusGatewayTimeout)
+		}()
+		next.ServeHTTP(sr, r)
+	})
+}
+
+// waitForDB pings the database with backoff until it answers or
+// database.startupTimeout expires, the last error is returned
+func (a *UsersApp) waitForDB() error {
+	deadline := time.Now().Add(currentConfig().Database.StartupTimeout)
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		err := a.DB.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		wait := backoff(attempt, connectRetryBase, connectRetryMax)
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		slog.Warn("Database unavailable", "attempt", attempt, "retry_in", wait.String(), "error", err)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,229 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client certificate policies for tls.clientAuth
+const (
+	// ClientAuthNone does not ask for client certificates
+	ClientAuthNone string = "none"
+	// ClientAuthOptional verifies a client certificate when one is sent
+	ClientAuthOptional string = "optional"
+	// ClientAuthRequire rejects connections without a verified certificate
+	ClientAuthRequire string = "require"
+)
+
+// certReloader serves the certificate and client CAs most recently
+// read from disk so rotated files are picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// newCertReloader reads the files once, an error means the server
+// can not start
+func newCertReloader(tc tlsConfig) (*certReloader, error) {
+	cr := &certReloader{certFile: tc.CertFile, keyFile: tc.KeyFile, caFile: tc.ClientCAFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// files returns the paths watched for changes
+func (cr *certReloader) files() []string {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.caFile != "" {
+		files = append(files, cr.caFile)
+	}
+	return files
+}
+
+// load reads the key pair and CA bundle, on error the previous ones
+// stay in use
+func (cr *certReloader) load() error {
+	modTimes := map[string]time.Time{}
+	for _, f := range cr.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if cr.caFile != "" {
+		pem, err := os.ReadFile(cr.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", cr.caFile)
+		}
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.clientCAs = pool
+	cr.modTimes = modTimes
+
+	return nil
+}
+
+// changed reports whether any file was modified since the last load
+func (cr *certReloader) changed() bool {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	for _, f := range cr.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			// Being replaced, try again later
+			return false
+		}
+		if !fi.ModTime().Equal(cr.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files when they change until ctx is canceled
+func (cr *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !cr.changed() {
+			continue
+		}
+		if err := cr.load(); err != nil {
+			slog.Error("Certificate reload failed", "error", err)
+			continue
+		}
+		slog.Info("Certificates reloaded", "cert", cr.certFile)
+	}
+}
+
+// serverConfig returns a TLS configuration that looks up the current
+// certificate and client CAs on every handshake
+func (cr *certReloader) serverConfig(clientAuth string) *tls.Config {
+	auth := tls.NoClientCert
+	switch clientAuth {
+	case ClientAuthOptional:
+		auth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		auth = tls.RequireAndVerifyClientCert
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.mu.RLock()
+			defer cr.mu.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cr.cert},
+				ClientAuth:   auth,
+				ClientCAs:    cr.clientCAs,
+			}, nil
+		},
+	}
+}
+
+// initializeTLS prepares srv to serve TLS, it returns false when no
+// certificate is configured
+func (a *UsersApp) initializeTLS(srv *http.Server) (bool, error) {
+	tc := currentConfig().TLS
+	if tc.CertFile == "" {
+		return false, nil
+	}
+
+	cr, err := newCertReloader(tc)
+	if err != nil {
+		return false, err
+	}
+	srv.TLSConfig = cr.serverConfig(tc.ClientAuth)
+
+	a.startWorker("certWatcher", cr.watch)
+
+	return true, nil
+}
+
+// subjectIdentity maps a client certificate subject to an identity name.
+// tls.identities is searched for the full subject, i.e. CN=ci,O=Acme,
+// then for CN=<common name>; without a match the common name is used
+func subjectIdentity(subject pkix.Name, identities map[string]string) (string, error) {
+	if name, ok := identities[subject.String()]; ok {
+		return name, nil
+	}
+	if name, ok := identities["CN="+subject.CommonName]; ok {
+		return name, nil
+	}
+	if subject.CommonName == "" {
+		return "", errors.New("client certificate has no common name")
+	}
+	return subject.CommonName, nil
+}
+
+// clientCertMiddleware sets the identity of callers that presented a
+// verified client certificate.  A certificate that names no identity
+// leaves the caller to authenticate another way
+func clientCertMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		leaf := r.TLS.VerifiedChains[0][0]
+		name, err := subjectIdentity(leaf.Subject, currentConfig().TLS.Identities)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Client certificate ignored", "subject", leaf.Subject.String(), "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := withIdentity(r.Context(), identity{Name: name, Method: AuthMTLS})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
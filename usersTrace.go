@@ -0,0 +1,163 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters selected with APP_TRACE_EXPORTER
+const (
+	// TraceNone spans are not recorded
+	TraceNone string = "none"
+	// TraceOTLP spans are sent to OTEL_EXPORTER_OTLP_ENDPOINT over HTTP
+	TraceOTLP string = "otlp"
+	// TraceFile spans are appended to APP_TRACE_FILE as JSON
+	TraceFile string = "file"
+)
+
+// tracerName identifies spans created by this service
+const tracerName string = "github.com/pavedroad-io/users"
+
+// tracer is looked up on each use so a provider installed later,
+// i.e. by tests, takes effect
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// initializeTracing installs the tracer provider for the configured
+// exporter, with none the default no-op provider is kept
+func (a *UsersApp) initializeTracing() error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	tc := currentConfig().Trace
+
+	var exporter sdktrace.SpanExporter
+	switch tc.Exporter {
+	case TraceNone, "":
+		return nil
+	case TraceOTLP:
+		// Endpoint, headers and TLS come from the standard
+		// OTEL_EXPORTER_OTLP_* environment variables
+		e, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			return err
+		}
+		exporter = e
+	case TraceFile:
+		f, err := os.OpenFile(tc.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		e, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		a.traceFile = f
+		exporter = e
+	default:
+		return fmt.Errorf("unknown trace exporter: %s", tc.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", UsersResourceType),
+		attribute.String("service.version", Version),
+	))
+	if err != nil {
+		return err
+	}
+
+	a.tracing = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tc.SampleRatio))),
+	)
+	otel.SetTracerProvider(a.tracing)
+
+	return nil
+}
+
+// shutdownTracing flushes buffered spans and closes the trace file
+func (a *UsersApp) shutdownTracing(ctx context.Context) error {
+	if a.tracing == nil {
+		return nil
+	}
+
+	err := a.tracing.Shutdown(ctx)
+	if a.traceFile != nil {
+		if e := a.traceFile.Close(); err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// tracingMiddleware starts a server span per request named by route
+// template.  A W3C traceparent header makes it a child of the caller's
+// span and the response carries the traceparent of this request
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc := propagation.TraceContext{}
+		ctx := tc.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := routeTemplate(r)
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		if ns, ok := mux.Vars(r)["namespace"]; ok {
+			span.SetAttributes(attribute.String("users.namespace", ns))
+		}
+
+		tc.Inject(ctx, propagation.HeaderCarrier(w.Header()))
+
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r.WithContext(ctx))
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", sr.status))
+		if sr.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sr.status))
+		}
+	})
+}
+
+// startStoreSpan traces one model operation
+func startStoreSpan(ctx context.Context, operation string) trace.Span {
+	_, span := tracer().Start(ctx, "store "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "postgresql"),
+			attribute.String("db.operation.name", operation),
+		))
+	return span
+}
@@ -0,0 +1,109 @@
+//
+// Copyright (c) PavedRoad. All rights reserved.
+// Licensed under the Apache2. See LICENSE file in the project root for full license information.
+//
+
+// User project / copyright / usage information
+// Microservice for managing a backend persistent store for an object
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// retrySerializationFailure is the SQLSTATE CockroachDB returns when a
+// transaction must be retried
+const retrySerializationFailure pq.ErrorCode = "40001"
+
+// Backoff between transaction attempts doubles from txRetryBase up to
+// txRetryMax, with jitter
+const (
+	txRetryBase = 10 * time.Millisecond
+	txRetryMax  = time.Second
+)
+
+// txRetries counts transaction attempts that were retried
+var txRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "users_db_tx_retries_total",
+	Help: "Transactions retried after a serialization failure by model operation.",
+}, []string{"operation"})
+
+// retryable reports whether err asks for the transaction to be retried
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == retrySerializationFailure
+}
+
+// backoff returns the wait before retry attempt n, n starts at 1,
+// doubling from base up to limit
+func backoff(n int, base, limit time.Duration) time.Duration {
+	d := base << uint(n-1)
+	if d <= 0 || d > limit {
+		d = limit
+	}
+	// Full jitter spreads out callers that conflicted with each other
+	return time.Duration(rand.Int63n(int64(d))) + time.Millisecond
+}
+
+// runInTx calls fn in a transaction and commits it.  Serialization
+// failures roll back and run fn again up to database.txRetries times,
+// so fn must not have side effects outside tx
+func runInTx(ctx context.Context, db *sql.DB, operation string, fn func(tx *sql.Tx) error) error {
+	retries := currentConfig().Database.TxRetries
+
+	for attempt := 0; ; attempt++ {
+		err := runTxOnce(ctx, db, fn)
+		if err == nil || !retryable(err) || attempt >= retries {
+			return err
+		}
+
+		txRetries.WithLabelValues(operation).Inc()
+		slog.DebugContext(ctx, "Retrying transaction", "operation", operation, "attempt", attempt+1, "error", err)
+
+		t := time.NewTimer(backoff(attempt+1, txRetryBase, txRetryMax))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// runTxOnce makes a single attempt at the transaction
+func runTxOnce(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applyPool sets the connection pool limits from database.pool, it is
+// called on startup and after each reload
+func (a *UsersApp) applyPool() {
+	if a.DB == nil {
+		return
+	}
+
+	p := currentConfig().Database.Pool
+	a.DB.SetMaxOpenConns(p.MaxOpenConns)
+	a.DB.SetMaxIdleConns(p.MaxIdleConns)
+	a.DB.SetConnMaxLifetime(p.ConnMaxLifetime)
+	a.DB.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+}
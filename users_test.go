@@ -4,18 +4,44 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 	_ "io/ioutil"
 	"log"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	_ "strconv"
 	"strings"
 	"testing"
 	"time"
+	"unicode"
 )
 
 const (
@@ -41,6 +67,12 @@ var newUsersJSON = `{
 var a UsersApp
 
 func TestMain(m *testing.M) {
+	c, err := loadConfig(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setConfig(c)
+
 	a = UsersApp{}
 	a.Initialize()
 
@@ -55,12 +87,7 @@ func TestMain(m *testing.M) {
 }
 
 func ensureTableExists() {
-	if _, err := a.DB.Exec(tableCreationQuery); err != nil {
-		fmt.Println("Table check failed:", err)
-		log.Fatal(err)
-	}
-
-	if _, err := a.DB.Exec(indexCreate); err != nil {
+	if _, err := migrateUp(a.DB); err != nil {
 		fmt.Println("Table check failed:", err)
 		log.Fatal(err)
 	}
@@ -71,6 +98,22 @@ func clearTable() {
 	if _, err := a.DB.Exec("DELETE FROM Acme.Users"); err != nil {
 		fmt.Println("Table clear failed:", err)
 	}
+
+	if _, err := a.DB.Exec("DELETE FROM Acme.usersSnapshotRecords"); err != nil {
+		fmt.Println("Table clear failed:", err)
+	}
+
+	if _, err := a.DB.Exec("DELETE FROM Acme.usersSnapshots"); err != nil {
+		fmt.Println("Table clear failed:", err)
+	}
+
+	if _, err := a.DB.Exec("DELETE FROM Acme.usersAudit"); err != nil {
+		fmt.Println("Table clear failed:", err)
+	}
+
+	if _, err := a.DB.Exec("DELETE FROM Acme.usersAPIKeys"); err != nil {
+		fmt.Println("Table clear failed:", err)
+	}
 }
 
 func clearDB() {
@@ -85,15 +128,6 @@ func clearDB() {
 
 }
 
-const tableCreationQuery = `
-CREATE TABLE IF NOT EXISTS Acme.users (
-    UsersUUID UUID DEFAULT uuid_v4()::UUID PRIMARY KEY,
-    users JSONB
-);`
-
-const indexCreate = `
-CREATE INDEX IF NOT EXISTS usersIdx ON Acme.users USING GIN (users);`
-
 func TestEmptyTable(t *testing.T) {
 	clearTable()
 
@@ -136,13 +170,17 @@ func TestGetWithBadUserUUID(t *testing.T) {
 
 	checkResponseCode(t, http.StatusBadRequest, response.Code)
 
-	var m map[string]string
-	err = json.Unmarshal(response.Body.Bytes(), &m)
+	if ct := response.Header().Get("Content-Type"); ct != ProblemContentType {
+		t.Errorf("Expected Content-Type %s. Got %s", ProblemContentType, ct)
+	}
+
+	var p problem
+	err = json.Unmarshal(response.Body.Bytes(), &p)
 	if err != nil {
 		fmt.Println("Unmarshal issue:", err)
 	}
-	if m["error"] != "400: invalid UUID: 43ae99c9" {
-		t.Errorf("Expected the 'error' key of the response to be set to '400: invalid UUID: 43ae99c9'. Got '%s'", m["error"])
+	if p.Status != http.StatusBadRequest || p.Code != CodeInvalidUUID || p.Detail != "invalid UUID: 43ae99c9" {
+		t.Errorf("Expected an invalid-uuid problem for 43ae99c9. Got %+v", p)
 	}
 }
 
@@ -324,6 +362,16 @@ func TestUpdateusers(t *testing.T) {
 	//	if m["active"] != "eslaf" {
 	//		t.Errorf("Expected active to be eslaf. Got %v", m["active"])
 	//	}
+
+	// The key in the URL decides, a different one in the body is refused
+	other := "9f5c1e3a-0b7d-4c4e-8a62-3d1b2f6e7a90"
+	req, _ = http.NewRequest("PUT", fmt.Sprintf(UsersURL, other), strings.NewReader(string(jb)))
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	ut.UsersUUID = ""
+	jb, _ = json.Marshal(ut)
+	req, _ = http.NewRequest("PUT", fmt.Sprintf(UsersURL, other), strings.NewReader(string(jb)))
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
 }
 
 func TestDeleteusers(t *testing.T) {
@@ -352,3 +400,1593 @@ func TestDumpUsers(t *testing.T) {
 	}
 }
 */
+
+// TestGenerateUsers
+// Generate records with a unique weighted field and check
+// they are stored
+//
+func TestGenerateUsers(t *testing.T) {
+	clearTable()
+
+	payload := []byte(`{
+		"count": 3,
+		"seed": 7,
+		"fields": {
+			"id": {"distribution": "weighted", "values": ["a", "b", "c"],
+				"weights": [1, 1, 1], "unique": true},
+			"metadata.id": {"nullRatio": 1}
+		}
+	}`)
+
+	req, _ := http.NewRequest("POST", "/api/v1/namespace/pavedroad.io/usersGENERATE", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var l []listResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &l); err != nil {
+		t.Errorf("Unmarshal issue: %v", err)
+	}
+	if len(l) != 3 {
+		t.Errorf("Expected 3 generated records. Got %d", len(l))
+	}
+
+	payload = []byte(`{"count": 4, "fields": {"id": {"values": ["a", "b"], "unique": true}}}`)
+	req, _ = http.NewRequest("POST", "/api/v1/namespace/pavedroad.io/usersGENERATE", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestGeneratorDistributions(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	g, err := newGenerator(generateRequest{
+		Count: 200,
+		Seed:  1,
+		Fields: map[string]fieldDistribution{
+			"created":           {From: from, To: to, Distribution: DistNormal},
+			"metadata.test.key": {NullRatio: 0.5},
+			"id":                {Distribution: DistNormal, MinLength: 4, MaxLength: 8, Mean: 6, StdDev: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newGenerator failed: %v", err)
+	}
+
+	docs, err := g.generate(200)
+	if err != nil {
+		t.Fatalf("generate failed: %v", err)
+	}
+
+	nulls := 0
+	for _, d := range docs {
+		c := d["created"].(time.Time)
+		if c.Before(from) || c.After(to) {
+			t.Errorf("created %v outside of window", c)
+		}
+		if u := d["updated"].(time.Time); u.Before(c) {
+			t.Errorf("updated %v before created %v", u, c)
+		}
+		if l := len(d["id"].(string)); l < 4 || l > 8 {
+			t.Errorf("id length %d outside of 4 to 8", l)
+		}
+		if d["Metadata"].(map[string]interface{})["Test"].(map[string]interface{})["key"] == nil {
+			nulls++
+		}
+	}
+
+	if nulls < 60 || nulls > 140 {
+		t.Errorf("Expected about half of the keys to be null. Got %d of 200", nulls)
+	}
+}
+
+func TestGeneratorEdgeMode(t *testing.T) {
+	g, err := newGenerator(generateRequest{
+		Mode:   ModeEdge,
+		Fields: map[string]fieldDistribution{"id": {MaxLength: 64}},
+	})
+	if err != nil {
+		t.Fatalf("newGenerator failed: %v", err)
+	}
+
+	docs, err := g.generate(edgeCaseCount())
+	if err != nil {
+		t.Fatalf("generate failed: %v", err)
+	}
+
+	found := map[interface{}]bool{}
+	for _, d := range docs {
+		found[d["id"]] = true
+		found[d["created"]] = true
+	}
+
+	for _, want := range []interface{}{nil, "", strings.Repeat("x", 64),
+		"'; DROP TABLE Acme.users; --", time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)} {
+		if !found[want] {
+			t.Errorf("Expected edge value %q to be generated", want)
+		}
+	}
+}
+
+func TestInferSchema(t *testing.T) {
+	sample := `{"id": "a", "created": "2019-12-20T14:46:09-05:00", "count": 1, "metadata": {"test": {"key": "k"}}}
+
+{"id": "b", "created": "2019-12-20T14:46:09-05:00", "count": 1.5, "metadata": {"test": {"key": null}}, "tags": ["x"]}
+`
+	s := newSchemaInferrer(UsersResourceType)
+	n, err := s.addNDJSON(strings.NewReader(sample))
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 documents without error. Got %d, %v", n, err)
+	}
+
+	def := s.schema()
+	if len(def.Tables) != 3 {
+		t.Fatalf("Expected users, metadata and test tables. Got %v", def.Tables)
+	}
+
+	want := map[string]schemaColumn{
+		"id":      {Name: "id", MappedName: "id", Type: ColString, Constraints: "not-null"},
+		"created": {Name: "created", MappedName: "created", Type: ColTime, Constraints: "not-null"},
+		"count":   {Name: "count", MappedName: "count", Type: ColNumber, Constraints: "not-null"},
+		"tags":    {Name: "tags", MappedName: "tags", Type: ColArray},
+	}
+	for _, c := range def.Tables[0].Columns {
+		if c != want[c.Name] {
+			t.Errorf("Expected column %v. Got %v", want[c.Name], c)
+		}
+	}
+
+	if tt := def.Tables[2]; tt.TableName != "test" || tt.ParentTables != "metadata" ||
+		tt.Columns[0].Constraints != "" {
+		t.Errorf("Expected nullable key in test table. Got %v", tt)
+	}
+}
+
+// TestSnapshotRestore
+// Take a snapshot, change the namespace, and check restore
+// returns it to the captured state
+//
+func TestSnapshotRestore(t *testing.T) {
+	clearTable()
+	nt := NewUsers()
+	uid := addUsers(nt)
+
+	snapshots := "/api/v1/namespace/pavedroad.io/snapshots"
+	req, _ := http.NewRequest("POST", snapshots, strings.NewReader(`{"name": "baseline"}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", snapshots, strings.NewReader(`{"name": "baseline"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf(UsersURL, uid), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	addUsers(NewUsers())
+
+	req, _ = http.NewRequest("POST", snapshots+"/baseline/restore", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf(UsersURL, uid), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/api/v1/namespace/pavedroad.io/usersLIST", nil)
+	response = executeRequest(req)
+	var l []listResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &l)
+	if len(l) != 1 {
+		t.Errorf("Expected 1 record after restore. Got %d", len(l))
+	}
+
+	req, _ = http.NewRequest("GET", snapshots, nil)
+	response = executeRequest(req)
+	var sl []snapshot
+	_ = json.Unmarshal(response.Body.Bytes(), &sl)
+	if len(sl) != 1 || sl[0].Records != 1 {
+		t.Errorf("Expected 1 snapshot with 1 record. Got %v", sl)
+	}
+
+	req, _ = http.NewRequest("POST", snapshots+"/missing/restore", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// TestCloneNamespace
+// Clone with fresh UUIDs and check the copy is reachable
+// in the new namespace only
+//
+func TestCloneNamespace(t *testing.T) {
+	clearTable()
+	uid := addUsers(NewUsers())
+
+	payload := `{"target": "shard-1", "freshUUIDs": true, "filter": {"id": "EpENHRGMvczU8Hx"}}`
+	req, _ := http.NewRequest("POST", "/api/v1/namespace/pavedroad.io/clone", strings.NewReader(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var result cloneResult
+	_ = json.Unmarshal(response.Body.Bytes(), &result)
+	if result.Records != 1 || result.UUIDs[uid] == "" {
+		t.Fatalf("Expected 1 record with a new UUID. Got %v", result)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/namespace/shard-1/users/"+result.UUIDs[uid], nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/api/v1/namespace/shard-1/users/"+uid, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("POST", "/api/v1/namespace/pavedroad.io/clone", strings.NewReader(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+func TestRemapUUIDs(t *testing.T) {
+	doc := map[string]interface{}{
+		"manager": "ce272b4c-2cbb-4782-a615-2b044deb8686",
+		"peers":   []interface{}{"ce272b4c-2cbb-4782-a615-2b044deb8686", "other"},
+	}
+	mapping := map[string]string{"ce272b4c-2cbb-4782-a615-2b044deb8686": "new"}
+
+	out := remapUUIDs(doc, mapping).(map[string]interface{})
+	if out["manager"] != "new" || out["peers"].([]interface{})[0] != "new" ||
+		out["peers"].([]interface{})[1] != "other" {
+		t.Errorf("Expected references to be remapped. Got %v", out)
+	}
+}
+
+func TestMaskPolicies(t *testing.T) {
+	m, err := newMasker(map[string]string{
+		"id":                MaskTokenize,
+		"metadata.id":       MaskFake,
+		"metadata.test.key": MaskRedact,
+		"created":           MaskShuffle,
+	}, "secret")
+	if err != nil {
+		t.Fatalf("newMasker failed: %v", err)
+	}
+
+	docs := []interface{}{}
+	for _, c := range []string{"2019-12-20T14:46:09Z", "2019-12-21T14:46:09Z"} {
+		var d map[string]interface{}
+		_ = json.Unmarshal([]byte(newUsersJSON), &d)
+		d["created"] = c
+		docs = append(docs, d)
+	}
+	m.apply(docs)
+
+	first := docs[0].(map[string]interface{})
+	second := docs[1].(map[string]interface{})
+	if first["id"] == "EpENHRGMvczU8Hx" || first["id"] != second["id"] {
+		t.Errorf("Expected equal tokens for equal ids. Got %v and %v", first["id"], second["id"])
+	}
+
+	md := first["metadata"].(map[string]interface{})
+	if fake := md["id"].(string); fake == "93fzn16nX22nsbE" || len(fake) != 15 ||
+		!unicode.IsDigit(rune(fake[0])) || !unicode.IsUpper(rune(fake[8])) {
+		t.Errorf("Expected a format preserving fake id. Got %v", fake)
+	}
+	if md["test"].(map[string]interface{})["key"] != MaskRedacted {
+		t.Errorf("Expected key to be redacted. Got %v", md["test"])
+	}
+
+	shuffled := map[interface{}]bool{first["created"]: true, second["created"]: true}
+	if !shuffled["2019-12-20T14:46:09Z"] || !shuffled["2019-12-21T14:46:09Z"] {
+		t.Errorf("Expected shuffle to keep the set of values. Got %v", shuffled)
+	}
+
+	if _, err := newMasker(map[string]string{"id": "scramble"}, ""); err == nil {
+		t.Errorf("Expected an unknown policy to be rejected")
+	}
+	if _, err := newMasker(map[string]string{"metadata.idd": MaskRedact}, ""); err == nil {
+		t.Errorf("Expected an unknown column to be rejected")
+	}
+
+	// Hashes depend on the key
+	h1, _ := newMasker(map[string]string{"id": MaskHash}, "one")
+	h2, _ := newMasker(map[string]string{"id": MaskHash}, "two")
+	if a, b := h1.mask(MaskHash, "x"), h2.mask(MaskHash, "x"); a == b || len(a.(string)) != 64 {
+		t.Errorf("Expected keyed hashes. Got %v and %v", a, b)
+	}
+}
+
+// TestUsersChild
+// Replace and patch the nested metadata/test child
+//
+func TestUsersChild(t *testing.T) {
+	clearTable()
+
+	// Records created through the API store the model keys Metadata and Test
+	req, _ := http.NewRequest("POST", "/api/v1/namespace/pavedroad.io/users", strings.NewReader(newUsersJSON))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var created users
+	_ = json.Unmarshal(response.Body.Bytes(), &created)
+	record := fmt.Sprintf(UsersURL, created.UsersUUID)
+
+	child := func(method, path, body string, status int) map[string]interface{} {
+		t.Helper()
+		req, _ := http.NewRequest(method, record+path, bytes.NewBufferString(body))
+		response := executeRequest(req)
+		checkResponseCode(t, status, response.Code)
+		var m map[string]interface{}
+		_ = json.Unmarshal(response.Body.Bytes(), &m)
+		return m
+	}
+
+	if m := child("GET", "/metadata/test", "", http.StatusOK); m["key"] != "gswgYlL54DgSJu9" {
+		t.Errorf("Expected the test child. Got %v", m)
+	}
+	if m := child("GET", "/metadata", "", http.StatusOK); m["id"] != "93fzn16nX22nsbE" {
+		t.Errorf("Expected the metadata child. Got %v", m)
+	}
+
+	child("PUT", "/metadata/test", `{"key": "replaced"}`, http.StatusOK)
+	if m := child("PATCH", "/metadata/test", `{"extra": "added"}`, http.StatusOK); m["key"] != "replaced" || m["extra"] != "added" {
+		t.Errorf("Expected replaced key and added extra. Got %v", m)
+	}
+	if m := child("PATCH", "/metadata", `{"id": "patched"}`, http.StatusOK); m["id"] != "patched" || m["Test"] == nil {
+		t.Errorf("Expected the id patched and Test kept. Got %v", m)
+	}
+
+	// Replacing metadata drops test
+	child("PUT", "/metadata", `{"id": "replaced"}`, http.StatusOK)
+	child("GET", "/metadata/test", "", http.StatusNotFound)
+	child("PUT", "/metadata/test", `{"key": "new"}`, http.StatusOK)
+
+	// The record still has a single metadata key
+	var jb []byte
+	if err := a.DB.QueryRow(`SELECT users FROM Acme.users WHERE UsersUUID = $1;`, created.UsersUUID).Scan(&jb); err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	_ = json.Unmarshal(jb, &doc)
+	md, _ := doc["Metadata"].(map[string]interface{})
+	if _, ok := doc["metadata"]; ok || md["id"] != "replaced" || md["Test"] == nil {
+		t.Errorf("Expected the changes under Metadata. Got %s", jb)
+	}
+
+	child("PUT", "/metadata/test", `["not", "an", "object"]`, http.StatusBadRequest)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf(UsersURL, "00000000-d01d-4c09-a4e7-59026d143b89")+"/metadata", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestLoadMigrations(t *testing.T) {
+	ml, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations failed: %v", err)
+	}
+
+	for i, m := range ml {
+		if m.version != i+1 {
+			t.Errorf("Expected migration %d. Got %d", i+1, m.version)
+		}
+	}
+}
+
+// TestMigrateDownUp
+// Revert the latest migration and apply it again
+//
+func TestMigrateDownUp(t *testing.T) {
+	if n, err := migrateDown(a.DB, 1); err != nil || n != 1 {
+		t.Fatalf("Expected 1 migration reverted. Got %d, %v", n, err)
+	}
+
+	states, err := migrationStatus(a.DB)
+	if err != nil || states[len(states)-1].Applied != nil {
+		t.Errorf("Expected the latest migration to be pending. Got %v, %v", states, err)
+	}
+
+	if n, err := migrateUp(a.DB); err != nil || n != 1 {
+		t.Fatalf("Expected 1 migration applied. Got %d, %v", n, err)
+	}
+}
+
+// TestMigrateUpgrade
+// A users table created before migrations and namespaces is
+// upgraded in place
+//
+func TestMigrateUpgrade(t *testing.T) {
+	defer func() {
+		clearDB()
+		ensureTableExists()
+	}()
+
+	ml, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 0001 is the schema the service created before migrations
+	clearDB()
+	if _, err := a.DB.Exec(ml[0].up); err != nil {
+		t.Fatal(err)
+	}
+	var uid string
+	insert := `INSERT INTO Acme.users(users) VALUES ($1) RETURNING UsersUUID;`
+	if err := a.DB.QueryRow(insert, newUsersJSON).Scan(&uid); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := migrateUp(a.DB); err != nil || n != len(ml) {
+		t.Fatalf("Expected %d migrations applied. Got %d, %v", len(ml), n, err)
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf(UsersURL, uid), nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	// Keys are unique per namespace only
+	clone := `INSERT INTO Acme.users(namespace, UsersUUID, users) VALUES ('other', $1, '{}');`
+	if _, err := a.DB.Exec(clone, uid); err != nil {
+		t.Errorf("Expected the key to be reusable in another namespace. Got %v", err)
+	}
+}
+
+func TestStopWorkers(t *testing.T) {
+	w := UsersApp{}
+	stopped := make(chan bool, 1)
+
+	w.startWorker("test", func(ctx context.Context) {
+		<-ctx.Done()
+		stopped <- true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := w.stopWorkers(ctx); err != nil {
+		t.Errorf("Expected workers to stop. Got %v", err)
+	}
+	if len(stopped) != 1 {
+		t.Errorf("Expected the worker to see its context canceled")
+	}
+
+	// A worker that ignores cancelation runs into the deadline
+	w = UsersApp{}
+	w.startWorker("stuck", func(ctx context.Context) { time.Sleep(time.Second) })
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := w.stopWorkers(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded. Got %v", err)
+	}
+}
+
+// TestHealthEndpoints
+// With the database up and migrated every probe passes
+//
+func TestHealthEndpoints(t *testing.T) {
+	for _, probe := range []string{"/healthz", "/readyz", "/livez"} {
+		req, _ := http.NewRequest("GET", probe, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var hr healthResponse
+		_ = json.Unmarshal(response.Body.Bytes(), &hr)
+		if hr.Status != HealthOK || len(hr.Checks) == 0 {
+			t.Errorf("Expected %s to report ok checks. Got %v", probe, hr)
+		}
+	}
+}
+
+func TestLivezStoppedWorker(t *testing.T) {
+	w := UsersApp{Router: mux.NewRouter()}
+	w.initializeHealthRoutes()
+	w.setWorkerStatus("reloader", false)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/livez", nil)
+	w.Router.ServeHTTP(rr, req)
+
+	checkResponseCode(t, http.StatusServiceUnavailable, rr.Code)
+	if !strings.Contains(rr.Body.String(), "stopped workers: reloader") {
+		t.Errorf("Expected the stopped worker to be reported. Got %s", rr.Body.String())
+	}
+}
+
+// TestMetricsEndpoint
+// Requests, database timings, pool stats and namespace counts
+// are exposed for Prometheus
+//
+func TestMetricsEndpoint(t *testing.T) {
+	clearTable()
+	uid := addUsers(NewUsers())
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf(UsersURL, uid), nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	body := response.Body.String()
+	for _, want := range []string{
+		`users_http_requests_total{code="200",method="GET",route="/api/v1/namespace/{namespace}/users/{key}"}`,
+		`users_db_query_duration_seconds_count{operation="getUsers"}`,
+		`go_sql_open_connections`,
+		`users_namespace_records{namespace="pavedroad.io"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	clearTable()
+	uid := addUsers(NewUsers())
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest("GET", fmt.Sprintf(UsersURL, uid), nil)
+	req.Header.Set("traceparent", parent)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if tp := response.Header().Get("traceparent"); !strings.Contains(tp, "4bf92f3577b34da6a3ce929d0e0e4736") {
+		t.Errorf("Expected traceparent in the same trace. Got %s", tp)
+	}
+
+	var server, store sdktrace.ReadOnlySpan
+	for _, s := range sr.Ended() {
+		switch s.Name() {
+		case "GET /api/v1/namespace/{namespace}/users/{key}":
+			server = s
+		case "store getUsers":
+			store = s
+		}
+	}
+
+	if server == nil || store == nil {
+		t.Fatalf("Expected server and store spans. Got %d spans", len(sr.Ended()))
+	}
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected server span parent 00f067aa0ba902b7. Got %s", server.Parent().SpanID())
+	}
+	if store.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Expected store span to be a child of the server span")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	initializeLogging(&buf)
+	defer initializeLogging(os.Stderr)
+
+	req, _ := http.NewRequest("GET", "/livez", nil)
+	req.Header.Set(RequestIDHeader, "fixture-setup-42")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	response := executeRequest(req)
+
+	if id := response.Header().Get(RequestIDHeader); id != "fixture-setup-42" {
+		t.Errorf("Expected request ID fixture-setup-42. Got %s", id)
+	}
+
+	var access map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("Expected JSON log records. Got %s", line)
+		}
+		if rec["msg"] == "access" {
+			access = rec
+		}
+	}
+	if access == nil || access["request_id"] != "fixture-setup-42" || access["status"] != float64(200) {
+		t.Errorf("Expected an access record with the request ID. Got %v", access)
+	}
+	if access["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || access["span_id"] == nil {
+		t.Errorf("Expected the access record to link to the trace. Got %v", access)
+	}
+
+	// One is assigned when missing and returned with errors
+	req, _ = http.NewRequest("GET", "/api/v1/namespace/pavedroad.io/users/43ae99c9", nil)
+	response = executeRequest(req)
+
+	var p problem
+	if err := json.Unmarshal(response.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if id := response.Header().Get(RequestIDHeader); id == "" || p.RequestID != id {
+		t.Errorf("Expected error request_id %s. Got %s", id, p.RequestID)
+	}
+}
+
+func TestAccessLogRefused(t *testing.T) {
+	var buf bytes.Buffer
+	initializeLogging(&buf)
+	defer initializeLogging(os.Stderr)
+
+	prev := *currentConfig()
+	defer setConfig(prev)
+
+	c := defaultConfig()
+	c.Auth.Anonymous = false
+	setConfig(c)
+
+	app := UsersApp{Router: mux.NewRouter()}
+	app.initializeRoutes()
+
+	req := httptest.NewRequest("GET", UsersAPIVersion+"/"+UsersNamespaceID+"/ns/"+UsersResourceType+"LIST", nil)
+	rr := httptest.NewRecorder()
+	app.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+
+	if !strings.Contains(buf.String(), `"msg":"access"`) || !strings.Contains(buf.String(), `"status":401`) {
+		t.Errorf("Expected an access record of the 401. Got %s", buf.String())
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := t.TempDir() + "/users.yaml"
+	file := `
+database:
+  port: 1000
+  password: secret
+http:
+  port: 9000
+  readTimeout: 5s
+`
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(ConfigFileEnv, path)
+	t.Setenv("APP_DB_PORT", "2000")
+	t.Setenv("HTTP_WRITE_TIMEOUT", "7")
+
+	fs := flag.NewFlagSet("users", flag.ContinueOnError)
+	registerConfigFlags(fs)
+	if err := fs.Parse([]string{"-db-port", "3000", "-db-auto-migrate"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flags win over the environment which wins over the file
+	if c.Database.Port != 3000 || !c.Database.AutoMigrate {
+		t.Errorf("Expected port 3000 with auto migrate from flags. Got %d %v", c.Database.Port, c.Database.AutoMigrate)
+	}
+	if c.HTTP.Port != 9000 || c.HTTP.ReadTimeout != 5*time.Second {
+		t.Errorf("Expected http port 9000 and 5s read timeout from the file. Got %d %s", c.HTTP.Port, c.HTTP.ReadTimeout)
+	}
+	if c.HTTP.WriteTimeout != 7*time.Second {
+		t.Errorf("Expected 7s write timeout from the environment. Got %s", c.HTTP.WriteTimeout)
+	}
+
+	var out bytes.Buffer
+	if err := runConfigCommand(c, []string{"dump"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), ": secret") || !strings.Contains(out.String(), "password: "+redacted) {
+		t.Errorf("Expected the password to be redacted. Got %s", out.String())
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	path := t.TempDir() + "/users.yaml"
+	if err := os.WriteFile(path, []byte("database:\n  prot: 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(ConfigFileEnv, path)
+	if _, err := loadConfig(nil); err == nil || !strings.Contains(err.Error(), "prot") {
+		t.Errorf("Expected an error for the unknown key. Got %v", err)
+	}
+
+	t.Setenv(ConfigFileEnv, "")
+	t.Setenv("HTTP_IP_PORT", "0")
+	t.Setenv("APP_LOG_LEVEL", "loud")
+
+	_, err := loadConfig(nil)
+	if err == nil {
+		t.Fatal("Expected validation errors")
+	}
+	for _, want := range []string{"http.port", "log.level"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error for %s. Got %s", want, err)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	prev := *currentConfig()
+	defer setConfig(prev)
+
+	path := t.TempDir() + "/users.yaml"
+	write := func(body string) {
+		if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("generator:\n  maxCount: 5\n")
+
+	fs := flag.NewFlagSet("users", flag.ContinueOnError)
+	registerConfigFlags(fs)
+	if err := fs.Parse([]string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	b := UsersApp{flags: fs}
+	if err := b.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	before := active.Load().version
+
+	write("generator:\n  maxCount: 7\nlog:\n  level: debug\ndatabase:\n  port: 1234\nauth:\n  admins: [ops]\n")
+	if err := b.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := currentConfig()
+	if c.Generator.MaxCount != 7 || logLevel.Level() != slog.LevelDebug {
+		t.Errorf("Expected reloaded generator and log settings. Got %d %s", c.Generator.MaxCount, logLevel.Level())
+	}
+	if c.Database.Port != prev.Database.Port {
+		t.Errorf("Expected database port to wait for a restart. Got %d", c.Database.Port)
+	}
+
+	// An invalid file keeps the active configuration
+	write("generator:\n  maxCount: 0\n")
+	if err := b.reloadConfig(); err == nil {
+		t.Error("Expected an invalid configuration to be rejected")
+	}
+
+	// Only admins can read it
+	req, _ := http.NewRequest("GET", "/admin/config", nil)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	req = req.WithContext(withIdentity(req.Context(), identity{Name: "ops", Method: AuthJWT}))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var v configVersion
+	if err := json.Unmarshal(response.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != before+1 || len(v.RestartRequired) != 1 || v.RestartRequired[0] != "database" {
+		t.Errorf("Expected version %d waiting on database. Got %+v", before+1, v)
+	}
+}
+
+// writeTestCert writes a PEM certificate and key signed by parent,
+// self signed when parent is nil, and returns them for signing others
+func writeTestCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	kb, _ := x509.MarshalECPrivateKey(key)
+	if err := os.WriteFile(dir+"/"+name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+"/"+name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test ca"},
+		NotBefore: now, NotAfter: now.Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	server := func(serial int64) {
+		writeTestCert(t, dir, "server", &x509.Certificate{
+			SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: "localhost"},
+			NotBefore: now, NotAfter: now.Add(time.Hour), DNSNames: []string{"localhost"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, ca, caKey)
+	}
+	server(2)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "ci-bot", Organization: []string{"Acme"}},
+		NotBefore: now, NotAfter: now.Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	prev := *currentConfig()
+	defer setConfig(prev)
+	c := prev
+	c.TLS = tlsConfig{ClientAuth: ClientAuthRequire, Identities: map[string]string{"CN=ci-bot,O=Acme": "ci"}}
+	setConfig(c)
+
+	cr, err := newCertReloader(tlsConfig{CertFile: dir + "/server.crt", KeyFile: dir + "/server.key", ClientCAFile: dir + "/ca.crt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen identity
+	h := clientCertMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = identityFrom(r.Context())
+	}))
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = cr.serverConfig(ClientAuthRequire)
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(withCert bool) (*http.Response, error) {
+		tc := &tls.Config{RootCAs: roots}
+		if withCert {
+			cert, err := tls.LoadX509KeyPair(dir+"/client.crt", dir+"/client.key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		return client.Get(srv.URL)
+	}
+
+	if _, err := get(false); err == nil {
+		t.Error("Expected a connection without a client certificate to fail")
+	}
+
+	resp, err := get(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("Expected server certificate 2. Got %d", serial)
+	}
+	if seen.Name != "ci" || seen.Method != AuthMTLS {
+		t.Errorf("Expected identity ci from the subject mapping. Got %+v", seen)
+	}
+
+	// A rotated certificate is served without restarting
+	server(4)
+	future := now.Add(time.Minute)
+	for _, f := range []string{"server.crt", "server.key"} {
+		if err := os.Chtimes(dir+"/"+f, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cr.changed() {
+		t.Fatal("Expected the rotated files to be detected")
+	}
+	if err := cr.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = get(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Errorf("Expected rotated server certificate 4. Got %d", serial)
+	}
+
+	// A certificate without an identity falls through to other methods
+	anonymous := false
+	handler := clientCertMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := identityFrom(r.Context())
+		anonymous = !ok
+	}))
+	req := httptest.NewRequest("GET", "/livez", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{Organization: []string{"Acme"}}}}}}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if !anonymous || rr.Code != http.StatusOK {
+		t.Errorf("Expected the request to go on without an identity. Got %d", rr.Code)
+	}
+}
+
+func TestDatabaseSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/password", []byte("it's secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("APP_DB_PASSWORD_FILE", dir+"/password")
+	t.Setenv("APP_DB_SSL_ROOT_CERT", "/certs/ca.crt")
+	t.Setenv("APP_DB_SSL_CERT", "/certs/client.root.crt")
+	t.Setenv("APP_DB_SSL_KEY", "/certs/client.root.key")
+	t.Setenv("APP_DB_SSL_MODE", "verify-full")
+
+	c, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Database.Password != "it's secret" {
+		t.Errorf("Expected the password from the file. Got %q", c.Database.Password)
+	}
+
+	cs := c.Database.connectionString()
+	for _, want := range []string{`password='it\'s secret'`, "sslmode=verify-full", "sslrootcert=/certs/ca.crt", "sslkey=/certs/client.root.key"} {
+		if !strings.Contains(cs, want) {
+			t.Errorf("Expected %s in %s", want, cs)
+		}
+	}
+
+	t.Setenv("APP_DB_PASSWORD", "both")
+	if _, err := loadConfig(nil); err == nil {
+		t.Error("Expected APP_DB_PASSWORD with APP_DB_PASSWORD_FILE to be rejected")
+	}
+	t.Setenv("APP_DB_PASSWORD", "")
+
+	t.Setenv("APP_DB_DSN", "postgresql://root:hunter2@db:26257/pavedroad?sslmode=verify-full")
+	if c, err = loadConfig(nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.Database.connectionString() != os.Getenv("APP_DB_DSN") {
+		t.Errorf("Expected the DSN to be used as given. Got %s", c.Database.connectionString())
+	}
+
+	var out bytes.Buffer
+	if err := runConfigCommand(c, []string{"dump"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "hunter2") || strings.Contains(out.String(), "it's secret") {
+		t.Errorf("Expected secrets to be redacted. Got %s", out.String())
+	}
+	if got := redactDSN("host=db password='a b' user=root"); got != "host=db password=REDACTED user=root" {
+		t.Errorf("Expected key=value password redacted. Got %s", got)
+	}
+}
+
+func TestTransactionRetry(t *testing.T) {
+	if !retryable(fmt.Errorf("update: %w", &pq.Error{Code: "40001"})) {
+		t.Error("Expected a serialization failure to be retried")
+	}
+	if retryable(&pq.Error{Code: "23505"}) || retryable(context.DeadlineExceeded) {
+		t.Error("Expected only serialization failures to be retried")
+	}
+
+	for n := 1; n <= 20; n++ {
+		if d := backoff(n, txRetryBase, txRetryMax); d <= 0 || d > txRetryMax+time.Millisecond {
+			t.Errorf("Expected backoff %d within (0, %s]. Got %s", n, txRetryMax, d)
+		}
+	}
+
+	prev := *currentConfig()
+	defer setConfig(prev)
+
+	db, err := sql.Open("postgres", "host=127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Setenv("APP_DB_MAX_OPEN_CONNS", "3")
+	b := UsersApp{DB: db}
+	if err := b.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Stats().MaxOpenConnections; n != 3 {
+		t.Errorf("Expected the reloaded pool limit. Got %d", n)
+	}
+	if pending := active.Load().pending; len(pending) != 0 {
+		t.Errorf("Expected pool limits to apply without a restart. Got %v", pending)
+	}
+
+	t.Setenv("APP_DB_MAX_OPEN_CONNS", "-1")
+	if _, err := loadConfig(nil); err == nil || !strings.Contains(err.Error(), "database.pool.maxOpenConns") {
+		t.Errorf("Expected a negative pool limit to be rejected. Got %v", err)
+	}
+}
+
+func TestStoreBreaker(t *testing.T) {
+	prev := *currentConfig()
+	defer setConfig(prev)
+
+	c := prev
+	c.Database.Breaker = breakerConfig{Failures: 2, Cooldown: 50 * time.Millisecond}
+	setConfig(c)
+
+	if !storeUnavailable(&net.OpError{Op: "dial", Err: errors.New("connection refused")}) ||
+		!storeUnavailable(fmt.Errorf("select: %w", &pq.Error{Code: "57P01"})) {
+		t.Error("Expected connection errors to make the store unavailable")
+	}
+	if storeUnavailable(&pq.Error{Code: "23505"}) || storeUnavailable(errors.New("404: missing")) {
+		t.Error("Expected rejected requests to leave the store available")
+	}
+
+	down, err := sql.Open("postgres", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	status := http.StatusServiceUnavailable
+	b := UsersApp{DB: down}
+	h := b.storeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	call := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", UsersAPIVersion+"/namespace/x/users/y", nil))
+		return rr
+	}
+
+	// Two failures open the breaker, then requests are rejected
+	call()
+	call()
+	status = http.StatusOK
+	rr := call()
+	checkResponseCode(t, http.StatusServiceUnavailable, rr.Code)
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After 1. Got %q", rr.Header().Get("Retry-After"))
+	}
+
+	// Routes outside the API are not affected
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	checkResponseCode(t, http.StatusOK, rr.Code)
+
+	// After the cooldown a failed ping opens it again, whatever the
+	// handler would have answered
+	time.Sleep(60 * time.Millisecond)
+	checkResponseCode(t, http.StatusServiceUnavailable, call().Code)
+	if b.breaker.state != BreakerOpen {
+		t.Errorf("Expected the breaker to open again. Got %s", b.breaker.state)
+	}
+
+	// A successful ping closes it
+	b.DB = a.DB
+	time.Sleep(60 * time.Millisecond)
+	checkResponseCode(t, http.StatusOK, call().Code)
+	checkResponseCode(t, http.StatusOK, call().Code)
+	if b.breaker.state != BreakerClosed {
+		t.Errorf("Expected the breaker to close. Got %s", b.breaker.state)
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	prev := *currentConfig()
+	defer setConfig(prev)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "k1", "use": "sig", "crv": "P-256", "x": %q, "y": %q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))))
+	path := t.TempDir() + "/jwks.json"
+	if err := os.WriteFile(path, []byte(jwks), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := prev
+	c.Auth = authConfig{JWT: jwtConfig{JWKSFile: path, Issuer: "https://issuer", Audience: "users", IdentityClaim: "sub"}}
+	setConfig(c)
+
+	b := UsersApp{}
+	if err := b.initializeAuth(); err != nil {
+		t.Fatal(err)
+	}
+	h := b.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := identityFrom(r.Context())
+		respondWithJSON(w, http.StatusOK, id)
+	}))
+
+	sign := func(method jwt.SigningMethod, signKey interface{}, claims jwt.MapClaims) string {
+		tok := jwt.NewWithClaims(method, claims)
+		tok.Header["kid"] = "k1"
+		s, err := tok.SignedString(signKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	valid := jwt.MapClaims{"sub": "alice", "iss": "https://issuer", "aud": "users", "exp": time.Now().Add(time.Minute).Unix()}
+	call := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := call(UsersAPIVersion+"/namespace/x/users", sign(jwt.SigningMethodES256, key, valid))
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	var id identity
+	if err := json.Unmarshal(rr.Body.Bytes(), &id); err != nil || id != (identity{Name: "alice", Method: AuthJWT}) {
+		t.Errorf("Expected alice authenticated by jwt. Got %s", rr.Body.String())
+	}
+
+	for name, claims := range map[string]jwt.MapClaims{
+		"audience": {"sub": "alice", "iss": "https://issuer", "aud": "other", "exp": valid["exp"]},
+		"issuer":   {"sub": "alice", "iss": "https://other", "aud": "users", "exp": valid["exp"]},
+		"expired":  {"sub": "alice", "iss": "https://issuer", "aud": "users", "exp": time.Now().Add(-time.Hour).Unix()},
+		"no exp":   {"sub": "alice", "iss": "https://issuer", "aud": "users"},
+	} {
+		rr := call(UsersAPIVersion+"/namespace/x/users", sign(jwt.SigningMethodES256, key, claims))
+		if rr.Code != http.StatusUnauthorized || !strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("Expected a token with a bad %s to be refused. Got %d", name, rr.Code)
+		}
+	}
+
+	// An HMAC token must not verify against the public key
+	hmacKey := elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+	checkResponseCode(t, http.StatusUnauthorized, call(UsersAPIVersion+"/x", sign(jwt.SigningMethodHS256, hmacKey, valid)).Code)
+
+	// Anonymous callers are refused on the API, probes stay open
+	checkResponseCode(t, http.StatusUnauthorized, call(UsersAPIVersion+"/x", "").Code)
+	checkResponseCode(t, http.StatusOK, call("/readyz", "").Code)
+
+	c.Auth.Anonymous = true
+	setConfig(c)
+	checkResponseCode(t, http.StatusOK, call(UsersAPIVersion+"/x", "").Code)
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	k := &apiKey{Name: "ci", Namespaces: []string{"pavedroad.io"}, Verbs: []string{VerbGet, VerbList}}
+
+	for _, tc := range []struct {
+		method, path string
+		vars         map[string]string
+		verb         string
+		allowed      bool
+	}{
+		{"GET", "/api/v1/namespace/pavedroad.io/usersLIST", map[string]string{"namespace": "pavedroad.io"}, VerbList, true},
+		{"GET", "/api/v1/namespace/pavedroad.io/users/x", map[string]string{"namespace": "pavedroad.io", "key": "x"}, VerbGet, true},
+		{"POST", "/api/v1/namespace/pavedroad.io/usersEXPORT", map[string]string{"namespace": "pavedroad.io"}, VerbList, true},
+		{"POST", "/api/v1/namespace/pavedroad.io/users", map[string]string{"namespace": "pavedroad.io"}, VerbCreate, false},
+		{"DELETE", "/api/v1/namespace/pavedroad.io/users/x", map[string]string{"namespace": "pavedroad.io", "key": "x"}, VerbDelete, false},
+		{"GET", "/api/v1/namespace/other/usersLIST", map[string]string{"namespace": "other"}, VerbList, false},
+		{"GET", "/admin/apikeys", nil, VerbList, false},
+		{"GET", "/readyz", nil, VerbList, true},
+	} {
+		req := mux.SetURLVars(httptest.NewRequest(tc.method, tc.path, nil), tc.vars)
+		if got := requestVerb(req); got != tc.verb {
+			t.Errorf("%s %s: expected verb %s. Got %s", tc.method, tc.path, tc.verb, got)
+		}
+		if reason := apiKeyScope(req, k); (reason == "") != tc.allowed {
+			t.Errorf("%s %s: expected allowed %t. Got %q", tc.method, tc.path, tc.allowed, reason)
+		}
+	}
+
+	id, secret, err := parseAPIKey(apiKeyPrefix + "0f6b5a34d1e14f0c9d3c2b1a09f8e7d6_a_b")
+	if err != nil || id != "0f6b5a34-d1e1-4f0c-9d3c-2b1a09f8e7d6" || secret != "a_b" {
+		t.Errorf("Expected the ID and secret. Got %s %s %v", id, secret, err)
+	}
+	for _, bad := range []string{"", "0f6b5a34d1e14f0c9d3c2b1a09f8e7d6_x", apiKeyPrefix + "nothex_x", apiKeyPrefix + "0f6b5a34d1e14f0c9d3c2b1a09f8e7d6_"} {
+		if _, _, err := parseAPIKey(bad); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+
+	req := apiKeyRequest{Name: "ci", Namespaces: []string{"pavedroad.io"}, Verbs: []string{"patch"}}
+	var ue *usersError
+	if err := req.validate(); !errors.As(err, &ue) || ue.status != http.StatusBadRequest {
+		t.Errorf("Expected an unknown verb to be refused. Got %v", err)
+	}
+}
+
+func TestRBAC(t *testing.T) {
+	prev := *currentConfig()
+	defer setConfig(prev)
+
+	c := defaultConfig()
+	c.Auth.Admins = []string{"root"}
+	c.RBAC = rbacConfig{Enabled: true, Bindings: []roleBinding{
+		{Identity: "alice", Role: RoleEditor, Namespaces: []string{"pavedroad.io"}},
+		{Identity: AnonymousIdentity, Role: RoleViewer, Namespaces: []string{AllNamespaces}},
+		{Identity: "ops", Role: RoleAdmin, Namespaces: []string{AllNamespaces}},
+	}}
+	if errs := c.validate(); len(errs) != 0 {
+		t.Fatalf("Expected the bindings to be valid. Got %v", errs)
+	}
+	setConfig(c)
+
+	for _, tc := range []struct {
+		name, verb, namespace string
+		allowed               bool
+	}{
+		{"alice", VerbDelete, "pavedroad.io", true},
+		{"alice", VerbDelete, "other", false},
+		{"alice", VerbAdmin, AllNamespaces, false},
+		{AnonymousIdentity, VerbList, "other", true},
+		{AnonymousIdentity, VerbCreate, "other", false},
+		{"ops", VerbAdmin, AllNamespaces, true},
+		{"root", VerbDelete, "other", true},
+		{"mallory", VerbGet, "pavedroad.io", false},
+	} {
+		if d := c.can(tc.name, tc.verb, tc.namespace); d.Allowed != tc.allowed {
+			t.Errorf("%s %s %s: expected allowed %t. Got %+v", tc.name, tc.verb, tc.namespace, tc.allowed, d)
+		}
+	}
+
+	// The middleware uses the identity of the request
+	handler := rbacMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	call := func(method, name, namespace string) int {
+		req := httptest.NewRequest(method, UsersAPIVersion+"/namespace/"+namespace+"/users", nil)
+		req = mux.SetURLVars(req, map[string]string{"namespace": namespace})
+		if name != "" {
+			req = req.WithContext(withIdentity(req.Context(), identity{Name: name, Method: AuthJWT}))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	checkResponseCode(t, http.StatusOK, call("POST", "alice", "pavedroad.io"))
+	checkResponseCode(t, http.StatusForbidden, call("POST", "alice", "other"))
+	checkResponseCode(t, http.StatusOK, call("GET", "", "other"))
+	checkResponseCode(t, http.StatusForbidden, call("POST", "", "other"))
+
+	// Without rbac everyone can use namespaces but only admins administer
+	c.RBAC.Enabled = false
+	if !c.can("mallory", VerbDelete, "other").Allowed || c.can("mallory", VerbAdmin, AllNamespaces).Allowed {
+		t.Errorf("Expected namespaces to be open and admin to be refused")
+	}
+
+	c.RBAC.Bindings = []roleBinding{{Identity: "", Role: "owner", Namespaces: []string{"bad namespace"}}}
+	if errs := c.validate(); len(errs) != 3 {
+		t.Errorf("Expected identity, role, and namespace errors. Got %v", errs)
+	}
+}
+
+func TestAuditDiff(t *testing.T) {
+	changes, err := diffDocuments(
+		[]byte(`{"id": "1", "metadata": {"id": "a", "test": {"key": "x"}}, "gone": true}`),
+		[]byte(`{"id": "1", "metadata": {"id": "b", "test": {"key": "x"}}, "a/b": [1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []auditChange{
+		{Path: "/a~1b", Op: "add", To: []interface{}{float64(1)}},
+		{Path: "/gone", Op: "remove", From: true},
+		{Path: "/metadata/id", Op: "replace", From: "a", To: "b"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %+v. Got %+v", expected, changes)
+	}
+
+	// Created records list every field
+	if changes, _ := diffDocuments(nil, []byte(`{"id": "1"}`)); len(changes) != 1 || changes[0].Op != "add" {
+		t.Errorf("Expected one added field. Got %+v", changes)
+	}
+
+	for _, bad := range []string{"namespace=bad%20namespace", "key=x", "since=yesterday", "limit=0",
+		"since=2026-01-02T00:00:00Z&until=2026-01-01T00:00:00Z"} {
+		v, _ := url.ParseQuery(bad)
+		var ue *usersError
+		if _, err := parseAuditQuery(v); !errors.As(err, &ue) || ue.status != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused. Got %v", bad, err)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	clearTable()
+
+	ctx := withIdentity(context.Background(), identity{Name: "alice", Method: AuthJWT})
+	u := users{Id: "audit"}
+	key, err := u.createUsers(ctx, a.DB, "pavedroad.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u.Id = "audited"
+	if err := u.updateUsers(ctx, a.DB, "pavedroad.io", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.deleteUsers(ctx, a.DB, "pavedroad.io", key); err != nil {
+		t.Fatal(err)
+	}
+
+	el, err := listAudit(context.Background(), a.DB, auditQuery{Key: key, Limit: defaultAuditLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(el) != 3 {
+		t.Fatalf("Expected 3 entries. Got %+v", el)
+	}
+
+	// Newest first
+	for i, action := range []string{AuditDelete, AuditUpdate, AuditCreate} {
+		if el[i].Action != action || el[i].Identity != "alice" || el[i].Namespace != "pavedroad.io" {
+			t.Errorf("Expected %s by alice. Got %+v", action, el[i])
+		}
+	}
+	if len(el[1].Diff) != 1 || el[1].Diff[0].Path != "/id" || el[1].Diff[0].To != "audited" {
+		t.Errorf("Expected the id change. Got %+v", el[1].Diff)
+	}
+
+	if el, err := listAudit(context.Background(), a.DB, auditQuery{Identity: "bob", Limit: 1}); err != nil || len(el) != 0 {
+		t.Errorf("Expected no entries for bob. Got %+v %v", el, err)
+	}
+}
+
+// TestAuditAppendOnly
+// No service code changes or removes audit entries
+//
+func TestAuditAppendOnly(t *testing.T) {
+	mutation := regexp.MustCompile(`(?is)\b(UPDATE|DELETE\s+FROM|UPSERT\s+INTO|TRUNCATE|ALTER\s+TABLE|DROP\s+TABLE)\s+(IF\s+EXISTS\s+)?(Acme\.)?usersAudit\b`)
+
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f, "_test.go") {
+			continue
+		}
+		src, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := mutation.Find(src); m != nil {
+			t.Errorf("Expected %s to only insert audit entries. Found %q", f, m)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var l rateLimiter
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if _, ok := l.take("a", 1, 3, now); !ok {
+			t.Fatalf("Expected request %d within the burst", i)
+		}
+	}
+	if wait, ok := l.take("a", 1, 3, now); ok || wait <= 0 || wait > time.Second {
+		t.Errorf("Expected a wait of up to a second. Got %s %t", wait, ok)
+	}
+	if _, ok := l.take("b", 1, 3, now); !ok {
+		t.Errorf("Expected other clients to have their own bucket")
+	}
+	if _, ok := l.take("a", 1, 3, now.Add(time.Second)); !ok {
+		t.Errorf("Expected a token after a second")
+	}
+
+	prev := *currentConfig()
+	defer setConfig(prev)
+
+	c := defaultConfig()
+	c.Limits = limitsConfig{Rate: 0.5, Burst: 1, MaxDocumentSize: 10}
+	setConfig(c)
+
+	app := &UsersApp{}
+	handler := auditMiddleware(app.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	call := func(path, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remote
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	checkResponseCode(t, http.StatusOK, call(UsersAPIVersion+"/x", "192.0.2.1:1000").Code)
+	rr := call(UsersAPIVersion+"/x", "192.0.2.1:1001")
+	checkResponseCode(t, http.StatusTooManyRequests, rr.Code)
+	if rr.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected Retry-After 2. Got %q", rr.Header().Get("Retry-After"))
+	}
+	checkResponseCode(t, http.StatusOK, call(UsersAPIVersion+"/x", "192.0.2.2:1000").Code)
+	checkResponseCode(t, http.StatusOK, call("/readyz", "192.0.2.1:1002").Code)
+
+	// Authenticated callers are limited by identity, not address
+	handler = auditMiddleware(app.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get("X-Name")
+		r = r.WithContext(withIdentity(r.Context(), identity{Name: name, Method: AuthJWT}))
+		app.identityRateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	})))
+	as := func(name, remote string) int {
+		req := httptest.NewRequest("GET", UsersAPIVersion+"/x", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Name", name)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	checkResponseCode(t, http.StatusOK, as("alice", "192.0.2.5:1000"))
+	checkResponseCode(t, http.StatusOK, as("bob", "192.0.2.5:1001"))
+	checkResponseCode(t, http.StatusTooManyRequests, as("alice", "192.0.2.6:1000"))
+
+	var ue *usersError
+	if err := checkDocumentSize([]byte(`{"id": "12345"}`)); !errors.As(err, &ue) || ue.code != CodeQuotaExceeded {
+		t.Errorf("Expected the document to exceed the quota. Got %v", err)
+	}
+
+	c.Limits = limitsConfig{Rate: 1, Burst: 0, MaxRecords: -1}
+	if errs := c.validate(); len(errs) != 2 {
+		t.Errorf("Expected burst and maxRecords errors. Got %v", errs)
+	}
+}
+
+func TestRateLimitBadCredentials(t *testing.T) {
+	prev := *currentConfig()
+	defer setConfig(prev)
+
+	c := defaultConfig()
+	c.Limits = limitsConfig{Rate: 0.5, Burst: 1}
+	setConfig(c)
+
+	app := UsersApp{Router: mux.NewRouter()}
+	app.initializeRoutes()
+
+	for _, code := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", UsersAPIVersion+"/"+UsersNamespaceID+"/ns/"+UsersResourceType+"LIST", nil)
+		req.RemoteAddr = "192.0.2.3:1000"
+		req.Header.Set("Authorization", "Bearer bad")
+		rr := httptest.NewRecorder()
+		app.Router.ServeHTTP(rr, req)
+		checkResponseCode(t, code, rr.Code)
+	}
+
+	// Refusals are counted
+	rr := httptest.NewRecorder()
+	app.Router.ServeHTTP(rr, httptest.NewRequest("GET", MetricsPath, nil))
+	want := `users_http_requests_total{code="429",method="GET",route="` + UsersAPIVersion + "/" +
+		UsersNamespaceID + "/{namespace}/" + UsersResourceType + `LIST"}`
+	if !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %s", want)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	clearTable()
+
+	prev := *currentConfig()
+	defer setConfig(prev)
+
+	c := prev
+	c.Limits.MaxRecords = 1
+	setConfig(c)
+
+	create := func() int {
+		req, _ := http.NewRequest("POST", "/api/v1/namespace/pavedroad.io/users", bytes.NewBufferString(newUsersJSON))
+		return executeRequest(req).Code
+	}
+	checkResponseCode(t, http.StatusCreated, create())
+	checkResponseCode(t, http.StatusInsufficientStorage, create())
+
+	// A generated batch that does not fit creates nothing
+	c.Limits.MaxRecords = 2
+	setConfig(c)
+	req, _ := http.NewRequest("POST", "/api/v1/namespace/pavedroad.io/usersGENERATE", bytes.NewBufferString(`{"count": 2}`))
+	checkResponseCode(t, http.StatusInsufficientStorage, executeRequest(req).Code)
+	var n int
+	if err := a.DB.QueryRow(`SELECT count(*) FROM Acme.users;`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("Expected the batch to be rolled back. Got %d records %v", n, err)
+	}
+
+	c.Limits.MaxRecords = 0
+	c.Limits.MaxDocumentSize = 10
+	setConfig(c)
+	checkResponseCode(t, http.StatusInsufficientStorage, create())
+}
+
+func TestProblemDetails(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+		detail string
+	}{
+		{errNotFound("%s does not exist", "x"), http.StatusNotFound, CodeNotFound, "x does not exist"},
+		{fmt.Errorf("clone: %w", errConflict("busy")), http.StatusConflict, CodeConflict, "busy"},
+		{errQuota("full"), http.StatusInsufficientStorage, CodeQuotaExceeded, "full"},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, CodeTimeout, "request timed out"},
+		{errors.New("pq: secret table details"), http.StatusInternalServerError, CodeInternal, "internal error"},
+	} {
+		rr := httptest.NewRecorder()
+		respondWithModelError(rr, tc.err)
+
+		var p problem
+		if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		if rr.Code != tc.status || p.Status != tc.status || p.Code != tc.code || p.Detail != tc.detail ||
+			p.Type != problemTypeBase+tc.code || rr.Header().Get("Content-Type") != ProblemContentType {
+			t.Errorf("%v: expected %d %s %q. Got %d %+v", tc.err, tc.status, tc.code, tc.detail, rr.Code, p)
+		}
+	}
+
+	// Panics become a 500 that is access logged, and later requests are
+	// still served
+	var buf bytes.Buffer
+	initializeLogging(&buf)
+	defer initializeLogging(os.Stderr)
+
+	handler := requestIDMiddleware(recoverMiddleware(logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("broken handler")
+	}))))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/panic", nil))
+
+	var p problem
+	_ = json.Unmarshal(rr.Body.Bytes(), &p)
+	if rr.Code != http.StatusInternalServerError || p.Code != CodeInternal || p.RequestID == "" {
+		t.Errorf("Expected an internal problem with a request ID. Got %d %+v", rr.Code, p)
+	}
+	if !strings.Contains(buf.String(), `"msg":"access"`) || !strings.Contains(buf.String(), `"status":500`) {
+		t.Errorf("Expected an access record of the panic. Got %s", buf.String())
+	}
+
+	// Unknown routes and methods are problems too
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{"GET", "/nowhere", http.StatusNotFound, CodeNotFound},
+		{"DELETE", "/livez", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		rr := executeRequest(req)
+
+		var p problem
+		_ = json.Unmarshal(rr.Body.Bytes(), &p)
+		if rr.Code != tc.status || p.Code != tc.code || p.RequestID == "" ||
+			rr.Header().Get("Content-Type") != ProblemContentType {
+			t.Errorf("%s %s: expected %d %s. Got %d %+v", tc.method, tc.path, tc.status, tc.code, rr.Code, p)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	clearTable()
+
+	// Key management needs an admin
+	req, _ := http.NewRequest("GET", "/admin/apikeys", nil)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	k, err := createAPIKey(context.Background(), a.DB, apiKeyRequest{
+		Name: "ci-bot", Namespaces: []string{"pavedroad.io"}, Verbs: []string{VerbList}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(k.Key, apiKeyPrefix) {
+		t.Fatalf("Expected the key to be returned. Got %+v", k)
+	}
+
+	call := func(method, url, key string) int {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set(APIKeyHeader, key)
+		return executeRequest(req).Code
+	}
+
+	checkResponseCode(t, http.StatusOK, call("GET", "/api/v1/namespace/pavedroad.io/usersLIST", k.Key))
+	checkResponseCode(t, http.StatusForbidden, call("GET", "/api/v1/namespace/other/usersLIST", k.Key))
+	checkResponseCode(t, http.StatusForbidden, call("DELETE", fmt.Sprintf(UsersURL, k.ID), k.Key))
+	checkResponseCode(t, http.StatusUnauthorized, call("GET", "/api/v1/namespace/pavedroad.io/usersLIST", k.Key+"x"))
+
+	if _, err := revokeAPIKey(context.Background(), a.DB, k.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkResponseCode(t, http.StatusUnauthorized, call("GET", "/api/v1/namespace/pavedroad.io/usersLIST", k.Key))
+
+	kl, err := listAPIKeys(context.Background(), a.DB)
+	if err != nil || len(kl) == 0 || kl[len(kl)-1].Revoked == nil || kl[len(kl)-1].Key != "" {
+		t.Errorf("Expected the revoked key to be listed without its secret. Got %+v %v", kl, err)
+	}
+}